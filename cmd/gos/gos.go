@@ -79,7 +79,8 @@ const FS_TOTAL_NEW_FILE_LIMIT_NAME = "fs/total-new-file"
 const FS_NEW_FILE_RATE_LIMIT_NAME = "fs/new-file"
 
 const HTTP_REQUEST_RATE_LIMIT_NAME = "http/request"
-const NO_TIMEOUT_OPTION_NAME = "no-timeout"
+const TIMEOUT_OPTION_NAME = "timeout"
+const NO_TIMEOUT_OPTION_NAME = "no-" + TIMEOUT_OPTION_NAME
 
 var DEFAULT_LIMITATIONS = []gopherscript.Limitation{
 	{Name: FS_READ_LIMIT_NAME, ByteRate: 1_000},
@@ -106,6 +107,9 @@ var DEFAULT_HTTP_REQUEST_OPTIONS = &gopherscript.HttpRequestOptions{
 	InsecureSkipVerify: true, //TODO: set to false
 }
 
+// topics shared by all the states, see the topics namespace
+var MESSAGE_TOPICS = gopherscript.NewMessageTopics()
+
 var KEY_PRIORITY = map[string]int{
 	"id":    -1000,
 	"name":  -999,
@@ -1126,7 +1130,7 @@ func startShell(state *gopherscript.State, ctx *gopherscript.Context, config REP
 
 				mod, err := gopherscript.ParseModule(inputString, "")
 				if err == nil {
-					checkErr := gopherscript.Check(mod)
+					checkErr := gopherscript.CheckWithContext(mod, ctx)
 					//some errors are ignored because they make no sense in the context of the shell
 					if checkErr != nil && !strings.Contains(checkErr.Error(), "not defined") {
 						err = checkErr
@@ -1174,6 +1178,23 @@ func startShell(state *gopherscript.State, ctx *gopherscript.Context, config REP
 	}
 }
 
+// requirementsPermissionsLimitations returns the permissions & limitations required by a module,
+// PermissionsLimitations panics if the requirements are invalid so the panic is turned into an error.
+func requirementsPermissionsLimitations(
+	mod *gopherscript.Module,
+	defaultLimitations []gopherscript.Limitation,
+	handleCustomType func(kind gopherscript.PermissionKind, name string, value gopherscript.Node) ([]gopherscript.Permission, bool, error),
+) (perms []gopherscript.Permission, limitations []gopherscript.Limitation, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("%v", v)
+		}
+	}()
+
+	perms, limitations = mod.Requirements.Object.PermissionsLimitations(mod.GlobalConstantDeclarations, nil, defaultLimitations, handleCustomType)
+	return perms, limitations, nil
+}
+
 func moveFlagsStart(args []string) {
 	index := 0
 
@@ -1501,19 +1522,14 @@ func main() {
 				panic(fmt.Sprint("parsing error: ", err.Error()))
 			}
 
-			if err := gopherscript.Check(mod); err != nil {
-				panic(fmt.Sprint("checking error: ", err.Error()))
-			}
-
 			var ctx *gopherscript.Context
 			passCLIArguments := false
 			if mod.Requirements == nil {
 				panic("missing requirements in script")
 			}
 
-			requiredPermissions, limitations := mod.Requirements.Object.PermissionsLimitations(
-				mod.GlobalConstantDeclarations,
-				nil,
+			requiredPermissions, limitations, err := requirementsPermissionsLimitations(
+				mod,
 				DEFAULT_LIMITATIONS,
 				func(kind gopherscript.PermissionKind, name string, value gopherscript.Node) ([]gopherscript.Permission, bool, error) {
 					if kind != gopherscript.ReadPerm || name != "cli-args" {
@@ -1530,6 +1546,10 @@ func main() {
 					return nil, true, nil //okay to not give a permission ???
 				},
 			)
+			if err != nil {
+				fmt.Print(err, "\n")
+				return
+			}
 
 			//set default limitations
 
@@ -1541,6 +1561,10 @@ func main() {
 				panic("some required permissions are not granted. Did you use -p=required ?")
 			}
 
+			if err := gopherscript.CheckWithContext(mod, ctx); err != nil {
+				panic(fmt.Sprint("checking error: ", err.Error()))
+			}
+
 			//CONTEXT & STATE
 
 			state := NewState(ctx)
@@ -1599,12 +1623,20 @@ func main() {
 				panic(fmt.Sprint("failed to read startup file ", startupScriptPath, ":", err))
 			}
 
-			startupMod, err := gopherscript.ParseAndCheckModule(string(b), "")
+			startupMod, err := gopherscript.ParseModule(string(b), "")
 			if err != nil {
 				log.Panicln("failed to parse & check startup file:", err)
 			}
-			requiredPermissions, limitations := startupMod.Requirements.Object.PermissionsLimitations(startupMod.GlobalConstantDeclarations, nil, nil, nil)
+			requiredPermissions, limitations, err := requirementsPermissionsLimitations(startupMod, nil, nil)
+			if err != nil {
+				fmt.Print("startup script: ", err, "\n")
+				return
+			}
 			ctx := gopherscript.NewContext(requiredPermissions, nil, limitations)
+
+			if err := gopherscript.CheckWithContext(startupMod, ctx); err != nil {
+				log.Panicln("failed to parse & check startup file:", err)
+			}
 			state := NewState(ctx)
 
 			startupResult, err := gopherscript.Eval(startupMod, state)
@@ -1692,7 +1724,7 @@ func main() {
 					globalScope[cmd] = func(cmd string) interface{} {
 						return gopherscript.ValOf(func(ctx *gopherscript.Context, args ...interface{}) (string, error) {
 							exArgs := []interface{}{
-								gopherscript.Option{Name: NO_TIMEOUT_OPTION_NAME, Value: true},
+								gopherscript.Option{Name: TIMEOUT_OPTION_NAME, Value: false},
 								gopherscript.Identifier(cmd),
 							}
 							exArgs = append(exArgs, args...)
@@ -1758,12 +1790,14 @@ top:
 			args = args[1:]
 		case gopherscript.Option:
 			switch a.Name {
-			case NO_TIMEOUT_OPTION_NAME:
+			//--no-timeout is evaluated to a timeout option with a value of false
+			case TIMEOUT_OPTION_NAME, NO_TIMEOUT_OPTION_NAME:
 				if timeoutDuration != 0 {
 					return "", fmt.Errorf(TIMEOUT_INCONSISTENCY_ERROR)
 				}
-				if boolean, isBool := a.Value.(bool); !boolean || !isBool {
-					return "", fmt.Errorf("ex: --%s should have a value of true", NO_TIMEOUT_OPTION_NAME)
+				expectedValue := a.Name == NO_TIMEOUT_OPTION_NAME
+				if boolean, isBool := a.Value.(bool); !isBool || boolean != expectedValue {
+					return "", fmt.Errorf("ex: --%s should have a value of %t", a.Name, expectedValue)
 				}
 
 				noTimeout = true
@@ -1860,6 +1894,10 @@ func NewState(ctx *gopherscript.Context) *gopherscript.State {
 			}),
 		},
 		"html": makeHtmlNamespace(),
+		"topics": gopherscript.Object{
+			"publish": gopherscript.ValOf(MESSAGE_TOPICS.Publish),
+			"consume": gopherscript.ValOf(MESSAGE_TOPICS.Consume),
+		},
 		"http": gopherscript.Object{
 			"get": gopherscript.ValOf(httpGet),
 			"getbody": gopherscript.ValOf(func(ctx *gopherscript.Context, args ...interface{}) ([]byte, error) {
@@ -2072,6 +2110,14 @@ func NewState(ctx *gopherscript.Context) *gopherscript.State {
 			result := gopherscript.List{}
 
 			switch fil := filter.(type) {
+			case *gopherscript.FunctionExpression, *gopherscript.FunctionDeclaration:
+				for _, e := range list {
+					res, err := gopherscript.CallGopherFunc(fil.(gopherscript.Func), state, gopherscript.List{e})
+					if err != nil {
+						return nil, err
+					}
+					result = append(result, res)
+				}
 			case gopherscript.Node:
 
 				//should ctx allow to do that instead ?
@@ -2104,6 +2150,20 @@ func NewState(ctx *gopherscript.Context) *gopherscript.State {
 			result := gopherscript.List{}
 
 			switch fil := filter.(type) {
+			case *gopherscript.FunctionExpression, *gopherscript.FunctionDeclaration:
+				for _, e := range list {
+					res, err := gopherscript.CallGopherFunc(fil.(gopherscript.Func), state, gopherscript.List{e})
+					if err != nil {
+						return nil, err
+					}
+					ok, isBool := res.(bool)
+					if !isBool {
+						return nil, fmt.Errorf("filter: the predicate should return a boolean, not a(n) %T", res)
+					}
+					if ok {
+						result = append(result, e)
+					}
+				}
 			case gopherscript.Node:
 				state.PushScope()
 				defer state.PopScope()
@@ -2845,7 +2905,7 @@ func checkHttpOptions(obj gopherscript.Object, profile *gopherscript.HttpProfile
 
 		//CHECK KEY
 
-		if k == gopherscript.IMPLICIT_KEY_LEN_KEY {
+		if k == gopherscript.IMPLICIT_KEY_LEN_KEY || k == gopherscript.KEY_ORDER_KEY {
 			continue
 		}
 
@@ -2903,6 +2963,15 @@ func setHttpProfile(ctx *gopherscript.Context, name gopherscript.Identifier, con
 	return ctx.SetHttpProfile(name, configObject)
 }
 
+// getURLHost returns the host of a URL (scheme & port included) or an empty host if the URL is invalid.
+func getURLHost(u gopherscript.URL) gopherscript.HTTPHost {
+	parsed, err := url.Parse(string(u))
+	if err != nil {
+		return ""
+	}
+	return gopherscript.HTTPHost(parsed.Scheme + "://" + parsed.Host)
+}
+
 func httpGet(ctx *gopherscript.Context, args ...interface{}) (*http.Response, error) {
 	var contentType mimetype
 	var URL gopherscript.URL
@@ -2968,7 +3037,7 @@ func httpGet(ctx *gopherscript.Context, args ...interface{}) (*http.Response, er
 		return nil, err
 	}
 
-	ctx.Take(HTTP_REQUEST_RATE_LIMIT_NAME, 1)
+	ctx.TakeForHost(HTTP_REQUEST_RATE_LIMIT_NAME, getURLHost(URL), 1)
 
 	client := getOrMakeHttpClient(opts)
 	req, err := http.NewRequest("GET", string(URL), nil)
@@ -3078,7 +3147,7 @@ func _httpPostPatch(ctx *gopherscript.Context, isPatch bool, args ...interface{}
 		return nil, err
 	}
 
-	ctx.Take(HTTP_REQUEST_RATE_LIMIT_NAME, 1)
+	ctx.TakeForHost(HTTP_REQUEST_RATE_LIMIT_NAME, getURLHost(URL), 1)
 
 	client := getOrMakeHttpClient(opts)
 	method := "POST"
@@ -3152,7 +3221,7 @@ func httpDelete(ctx *gopherscript.Context, args ...interface{}) (*http.Response,
 		return nil, err
 	}
 
-	ctx.Take(HTTP_REQUEST_RATE_LIMIT_NAME, 1)
+	ctx.TakeForHost(HTTP_REQUEST_RATE_LIMIT_NAME, getURLHost(URL), 1)
 
 	client := getOrMakeHttpClient(opts)
 	req, err := http.NewRequest("DELETE", string(URL), nil)
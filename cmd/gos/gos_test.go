@@ -319,3 +319,63 @@ func TestHttpProfiles(t *testing.T) {
 		assert.NotEmpty(t, resp.Request.Cookies())
 	})
 }
+
+func TestHigherOrderListFunctions(t *testing.T) {
+
+	eval := func(t *testing.T, script string) (interface{}, error) {
+		ctx := G.NewContext([]G.Permission{
+			G.GlobalVarPermission{Kind_: G.ReadPerm, Name: "*"},
+			G.GlobalVarPermission{Kind_: G.UsePerm, Name: "*"},
+			G.GlobalVarPermission{Kind_: G.CreatePerm, Name: "*"},
+		}, nil, nil)
+		return G.Eval(G.MustParseModule(script), NewState(ctx))
+	}
+
+	t.Run("map with a function", func(t *testing.T) {
+		res, err := eval(t, `return map(fn(x){ return ($x + 1) }, [1, 2, 3])!`)
+		assert.NoError(t, err)
+		assert.Equal(t, G.List{2, 3, 4}, res)
+	})
+
+	t.Run("filter with a function", func(t *testing.T) {
+		res, err := eval(t, `return filter(fn(x){ return ($x > 1) }, [1, 2, 3])!`)
+		assert.NoError(t, err)
+		assert.Equal(t, G.List{2, 3}, res)
+	})
+
+	t.Run("filter with a function not returning a boolean", func(t *testing.T) {
+		_, err := eval(t, `return filter(fn(x){ return $x }, [1, 2, 3])!`)
+		assert.Error(t, err)
+	})
+
+	t.Run("the errors of the function should be propagated", func(t *testing.T) {
+		_, err := eval(t, `return map(fn(x){ return $$missing }, [1])!`)
+		assert.ErrorContains(t, err, "missing")
+	})
+}
+
+func TestRequirementsPermissionsLimitations(t *testing.T) {
+
+	t.Run("valid requirements", func(t *testing.T) {
+		mod := G.MustParseModule(`
+			require {
+				read: {globals: "*"}
+			}
+		`)
+		perms, _, err := requirementsPermissionsLimitations(mod, nil, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, []G.Permission{G.GlobalVarPermission{Kind_: G.ReadPerm, Name: "*"}}, perms)
+	})
+
+	t.Run("unsupported unit in limits", func(t *testing.T) {
+		mod := G.MustParseModule(`
+			require {
+				limits: {
+					"execution/total-time": 1min
+				}
+			}
+		`)
+		_, _, err := requirementsPermissionsLimitations(mod, nil, nil)
+		assert.ErrorContains(t, err, "unsupported unit")
+	})
+}
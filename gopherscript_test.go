@@ -1,10 +1,17 @@
 package gopherscript
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -251,6 +258,33 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("flag literal : negated", func(t *testing.T) {
+		n := MustParseModule("--no-color")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 10}, nil, nil},
+			Statements: []Node{
+				&FlagLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 10}, nil, nil},
+					Name:     "color",
+					Negated:  true,
+				},
+			},
+		}, n)
+	})
+
+	t.Run("flag literal : no- prefix without name", func(t *testing.T) {
+		n := MustParseModule("--no-")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+			Statements: []Node{
+				&FlagLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+					Name:     "no-",
+				},
+			},
+		}, n)
+	})
+
 	t.Run("flag literal : single dash not followed by characters", func(t *testing.T) {
 		n, err := ParseModule("-", "")
 		assert.Error(t, err)
@@ -577,6 +611,127 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("absolute path literal : escaped dollar sign", func(t *testing.T) {
+		n := MustParseModule(`/a\$b`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+			Statements: []Node{
+				&AbsolutePathLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+					Value:    "/a$b",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("relative path literal : escaped dollar sign", func(t *testing.T) {
+		n := MustParseModule(`./a\$b`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+			Statements: []Node{
+				&RelativePathLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+					Value:    "./a$b",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("absolute path literal : escaped comma", func(t *testing.T) {
+		n := MustParseModule(`/a\,b`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+			Statements: []Node{
+				&AbsolutePathLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+					Value:    "/a,b",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("absolute path literal : escaped colon", func(t *testing.T) {
+		n := MustParseModule(`/a\:b`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+			Statements: []Node{
+				&AbsolutePathLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+					Value:    "/a:b",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("relative path literal : escaped bracket", func(t *testing.T) {
+		n := MustParseModule(`./a\[b`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+			Statements: []Node{
+				&RelativePathLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+					Value:    "./a[b",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("absolute path pattern literal : escaped comma", func(t *testing.T) {
+		n := MustParseModule(`/a\,*`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+			Statements: []Node{
+				&AbsolutePathPatternLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+					Value:    "/a\\,*",
+				},
+			},
+		}, n)
+	})
+
+	t.Run("path literal followed by a comma in a list", func(t *testing.T) {
+		n := MustParseModule(`[/a\,b, /c]`)
+		list := n.Statements[0].(*ListLiteral)
+		assert.Len(t, list.Elements, 2)
+		assert.Equal(t, "/a,b", list.Elements[0].(*AbsolutePathLiteral).Value)
+		assert.Equal(t, "/c", list.Elements[1].(*AbsolutePathLiteral).Value)
+	})
+
+	t.Run("absolute path expression : escaped dollar sign before an interpolation", func(t *testing.T) {
+		n := MustParseModule(`/a\$b/$name$`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
+			Statements: []Node{
+				&AbsolutePathExpression{
+					NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
+					Slices: []Node{
+						&PathSlice{
+							NodeBase: NodeBase{
+								NodeSpan{0, 6},
+								nil,
+								nil,
+							},
+							Value: "/a$b/",
+						},
+						&Variable{
+							NodeBase: NodeBase{
+								NodeSpan{6, 11},
+								nil,
+								nil,
+							},
+							Name: "name",
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("absolute path expression : unterminated interpolation after an escaped dollar sign", func(t *testing.T) {
+		_, err := ParseModule(`/a\$b/$name`, "")
+		assert.Error(t, err)
+	})
+
 	t.Run("regex literal : empty", func(t *testing.T) {
 		n := MustParseModule(`%""`)
 		assert.EqualValues(t, &Module{
@@ -1097,6 +1252,19 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("HTTP host pattern : https://*.<tld>:*", func(t *testing.T) {
+		n := MustParseModule(`https://*.com:*`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 15}, nil, nil},
+			Statements: []Node{
+				&HTTPHostPatternLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 15}, nil, nil},
+					Value:    "https://*.com:*",
+				},
+			},
+		}, n)
+	})
+
 	t.Run("HTTP host pattern : https://*.<tld>", func(t *testing.T) {
 		n := MustParseModule(`https://*.com`)
 		assert.EqualValues(t, &Module{
@@ -1541,6 +1709,52 @@ func TestMustParseModule(t *testing.T) {
 		})
 	})
 
+	t.Run("rune literal : unicode escape", func(t *testing.T) {
+		n := MustParseModule(`'\u00e9'`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 8}, nil, nil},
+			Statements: []Node{
+				&RuneLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 8}, nil, nil},
+					Value:    'é',
+				},
+			},
+		}, n)
+	})
+
+	t.Run("rune literal : long unicode escape", func(t *testing.T) {
+		n := MustParseModule(`'\U0001F600'`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
+			Statements: []Node{
+				&RuneLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
+					Value:    '\U0001F600',
+				},
+			},
+		}, n)
+	})
+
+	t.Run("rune literal : hexadecimal escape", func(t *testing.T) {
+		n := MustParseModule(`'\x41'`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+			Statements: []Node{
+				&RuneLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+					Value:    'A',
+				},
+			},
+		}, n)
+	})
+
+	t.Run("rune literal : invalid unicode escapes", func(t *testing.T) {
+		for _, src := range []string{`'\u00g9'`, `'\u00e'`, `'\x4'`, `'\x`, `'\uD800'`} {
+			_, err := ParseModule(src, "")
+			assert.Error(t, err, src)
+		}
+	})
+
 	t.Run("rune literal : missing character", func(t *testing.T) {
 		assert.Panics(t, func() {
 			MustParseModule(`''`)
@@ -1839,6 +2053,52 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("call with paren: trailing comma", func(t *testing.T) {
+		n := MustParseModule("f(a,b,)")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 7}, nil, nil},
+			Statements: []Node{
+				&Call{
+					NodeBase: NodeBase{NodeSpan{0, 7}, nil, nil},
+					Callee: &IdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{0, 1}, nil, nil},
+						Name:     "f",
+					},
+					Arguments: []Node{
+						&IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{2, 3}, nil, nil},
+							Name:     "a",
+						},
+						&IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{4, 5}, nil, nil},
+							Name:     "b",
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("call with paren: empty argument between two commas", func(t *testing.T) {
+		_, err := ParseModule("f(a,,b)", "")
+		assert.Error(t, err)
+
+		_, err = ParseModule("f(a, ,b)", "")
+		assert.Error(t, err)
+	})
+
+	t.Run("call with paren: leading comma", func(t *testing.T) {
+		_, err := ParseModule("f(,a)", "")
+		assert.Error(t, err)
+	})
+
+	t.Run("call with paren: callee is a member expression, empty argument between two commas", func(t *testing.T) {
+		_, err := ParseModule("$a.b(1,,2)", "")
+		assert.Error(t, err)
+
+		MustParseModule("$a.b(1,2,)")
+	})
+
 	t.Run("call without paren: one arg", func(t *testing.T) {
 		n := MustParseModule("print $a")
 		assert.EqualValues(t, &Module{
@@ -2044,6 +2304,47 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("pipeline statement: second stage is a break statement", func(t *testing.T) {
+		n := MustParseModule("print $a | break")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 16}, nil, nil},
+			Statements: []Node{
+				&PipelineStatement{
+					NodeBase: NodeBase{NodeSpan{0, 16}, nil, nil},
+					Stages: []*PipelineStage{
+						{
+							Kind: NormalStage,
+							Expr: &Call{
+								Must:     true,
+								NodeBase: NodeBase{NodeSpan{0, 8}, nil, nil},
+								Callee: &IdentifierLiteral{
+									NodeBase: NodeBase{NodeSpan{0, 5}, nil, nil},
+									Name:     "print",
+								},
+								Arguments: []Node{
+									&Variable{
+										NodeBase: NodeBase{NodeSpan{6, 8}, nil, nil},
+										Name:     "a",
+									},
+								},
+							},
+						},
+						{
+							Kind: NormalStage,
+							Expr: &BreakStatement{
+								NodeBase: NodeBase{
+									NodeSpan{11, 16},
+									nil,
+									[]Token{{BREAK_KEYWORD, NodeSpan{11, 16}}},
+								},
+							},
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
 	t.Run("pipeline statement: second stage is a call with no arguments, followed by another statement on the following line", func(t *testing.T) {
 		n := MustParseModule("print $a | do-something\n1")
 		assert.EqualValues(t, &Module{
@@ -2407,6 +2708,47 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("member expression : left is a call", func(t *testing.T) {
+		n := MustParseModule(`$a.b().c`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 8}, nil, nil},
+			Statements: []Node{
+				&MemberExpression{
+					NodeBase: NodeBase{NodeSpan{0, 8}, nil, nil},
+					Left: &Call{
+						NodeBase: NodeBase{NodeSpan{0, 6}, nil, nil},
+						Callee: &MemberExpression{
+							NodeBase: NodeBase{NodeSpan{0, 4}, nil, nil},
+							Left: &Variable{
+								NodeBase: NodeBase{NodeSpan{0, 2}, nil, nil},
+								Name:     "a",
+							},
+							PropertyName: &IdentifierLiteral{
+								NodeBase: NodeBase{NodeSpan{3, 4}, nil, nil},
+								Name:     "b",
+							},
+						},
+						Arguments: nil,
+					},
+					PropertyName: &IdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{7, 8}, nil, nil},
+						Name:     "c",
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("call with paren : callee is a member expression whose left is a call", func(t *testing.T) {
+		n := MustParseModule(`$a.b().c()`)
+		call := n.Statements[0].(*Call)
+		assert.Equal(t, NodeSpan{0, 10}, call.Span)
+
+		callee := call.Callee.(*MemberExpression)
+		assert.Equal(t, NodeSpan{0, 8}, callee.Span)
+		assert.Equal(t, NodeSpan{0, 6}, callee.Left.(*Call).Span)
+	})
+
 	t.Run("call with paren : callee is a member expression", func(t *testing.T) {
 		n := MustParseModule(`$a.b("a")`)
 		assert.EqualValues(t, &Module{
@@ -3904,22 +4246,122 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
-	t.Run("binary expression: range", func(t *testing.T) {
-		n := MustParseModule("($a .. $b)")
+	t.Run("chained binary expression: precedence", func(t *testing.T) {
+		n := MustParseModule("(a + b * c)")
 		assert.EqualValues(t, &Module{
-			NodeBase: NodeBase{
-				NodeSpan{0, 10},
-				nil,
-				nil,
-			},
+			NodeBase: NodeBase{NodeSpan{0, 11}, nil, nil},
 			Statements: []Node{
 				&BinaryExpression{
 					NodeBase: NodeBase{
-						NodeSpan{0, 10},
+						NodeSpan{0, 11},
 						nil,
 						[]Token{
 							{OPENING_PARENTHESIS, NodeSpan{0, 1}},
-							{BINARY_OPERATOR, NodeSpan{4, 6}},
+							{BINARY_OPERATOR, NodeSpan{3, 4}},
+							{CLOSING_PARENTHESIS, NodeSpan{10, 11}},
+						},
+					},
+					Operator: Add,
+					Left: &IdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{1, 2}, nil, nil},
+						Name:     "a",
+					},
+					Right: &BinaryExpression{
+						NodeBase: NodeBase{
+							NodeSpan{5, 10},
+							nil,
+							[]Token{{BINARY_OPERATOR, NodeSpan{7, 8}}},
+						},
+						Operator: Mul,
+						Left: &IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{5, 6}, nil, nil},
+							Name:     "b",
+						},
+						Right: &IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{9, 10}, nil, nil},
+							Name:     "c",
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("chained binary expression: left associativity", func(t *testing.T) {
+		n := MustParseModule("(a - b - c)")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 11}, nil, nil},
+			Statements: []Node{
+				&BinaryExpression{
+					NodeBase: NodeBase{
+						NodeSpan{0, 11},
+						nil,
+						[]Token{
+							{OPENING_PARENTHESIS, NodeSpan{0, 1}},
+							{BINARY_OPERATOR, NodeSpan{7, 8}},
+							{CLOSING_PARENTHESIS, NodeSpan{10, 11}},
+						},
+					},
+					Operator: Sub,
+					Left: &BinaryExpression{
+						NodeBase: NodeBase{
+							NodeSpan{1, 6},
+							nil,
+							[]Token{{BINARY_OPERATOR, NodeSpan{3, 4}}},
+						},
+						Operator: Sub,
+						Left: &IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{1, 2}, nil, nil},
+							Name:     "a",
+						},
+						Right: &IdentifierLiteral{
+							NodeBase: NodeBase{NodeSpan{5, 6}, nil, nil},
+							Name:     "b",
+						},
+					},
+					Right: &IdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{9, 10}, nil, nil},
+						Name:     "c",
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("chained binary expression: logical and comparison operators", func(t *testing.T) {
+		n := MustParseModule("(a < b or b == c and c > d)")
+		expr := n.Statements[0].(*BinaryExpression)
+
+		assert.Equal(t, Or, expr.Operator)
+		assert.Equal(t, LessThan, expr.Left.(*BinaryExpression).Operator)
+
+		and := expr.Right.(*BinaryExpression)
+		assert.Equal(t, And, and.Operator)
+		assert.Equal(t, Equal, and.Left.(*BinaryExpression).Operator)
+		assert.Equal(t, GreaterThan, and.Right.(*BinaryExpression).Operator)
+	})
+
+	t.Run("chained binary expression: missing operator", func(t *testing.T) {
+		_, err := ParseModule("(a + b c)", "")
+		assert.Error(t, err)
+	})
+
+	t.Run("binary expression: range", func(t *testing.T) {
+		n := MustParseModule("($a .. $b)")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{
+				NodeSpan{0, 10},
+				nil,
+				nil,
+			},
+			Statements: []Node{
+				&BinaryExpression{
+					NodeBase: NodeBase{
+						NodeSpan{0, 10},
+						nil,
+						[]Token{
+							{OPENING_PARENTHESIS, NodeSpan{0, 1}},
+							{BINARY_OPERATOR, NodeSpan{4, 6}},
 							{CLOSING_PARENTHESIS, NodeSpan{9, 10}},
 						},
 					},
@@ -3986,6 +4428,156 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("binary expression: nil coalescing", func(t *testing.T) {
+		n := MustParseModule("($a ?? $b)")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{
+				NodeSpan{0, 10},
+				nil,
+				nil,
+			},
+			Statements: []Node{
+				&BinaryExpression{
+					NodeBase: NodeBase{
+						NodeSpan{0, 10},
+						nil,
+						[]Token{
+							{OPENING_PARENTHESIS, NodeSpan{0, 1}},
+							{BINARY_OPERATOR, NodeSpan{4, 6}},
+							{CLOSING_PARENTHESIS, NodeSpan{9, 10}},
+						},
+					},
+					Operator: NilCoalescing,
+					Left: &Variable{
+						NodeBase: NodeBase{
+							NodeSpan{1, 3},
+							nil,
+							nil,
+						},
+						Name: "a",
+					},
+					Right: &Variable{
+						NodeBase: NodeBase{
+							NodeSpan{7, 9},
+							nil,
+							nil,
+						},
+						Name: "b",
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("conditional expression", func(t *testing.T) {
+		n := MustParseModule("($a ? 1 : 2)")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{
+				NodeSpan{0, 12},
+				nil,
+				nil,
+			},
+			Statements: []Node{
+				&ConditionalExpression{
+					NodeBase: NodeBase{
+						NodeSpan{0, 12},
+						nil,
+						[]Token{
+							{OPENING_PARENTHESIS, NodeSpan{0, 1}},
+							{QUESTION_MARK, NodeSpan{4, 5}},
+							{COLON, NodeSpan{8, 9}},
+							{CLOSING_PARENTHESIS, NodeSpan{11, 12}},
+						},
+					},
+					Test: &Variable{
+						NodeBase: NodeBase{
+							NodeSpan{1, 3},
+							nil,
+							nil,
+						},
+						Name: "a",
+					},
+					Consequent: &IntLiteral{
+						NodeBase: NodeBase{
+							NodeSpan{6, 7},
+							nil,
+							nil,
+						},
+						Raw:   "1",
+						Value: 1,
+					},
+					Alternate: &IntLiteral{
+						NodeBase: NodeBase{
+							NodeSpan{10, 11},
+							nil,
+							nil,
+						},
+						Raw:   "2",
+						Value: 2,
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("conditional expression : no spaces", func(t *testing.T) {
+		n := MustParseModule("($a?1:2)")
+		expr := n.Statements[0].(*ConditionalExpression)
+
+		assert.Nil(t, expr.Err)
+		assert.Equal(t, NodeSpan{0, 8}, expr.Span)
+		assert.Equal(t, &Variable{NodeBase: NodeBase{Span: NodeSpan{1, 3}}, Name: "a"}, expr.Test)
+		assert.Equal(t, []Token{
+			{OPENING_PARENTHESIS, NodeSpan{0, 1}},
+			{QUESTION_MARK, NodeSpan{3, 4}},
+			{COLON, NodeSpan{5, 6}},
+			{CLOSING_PARENTHESIS, NodeSpan{7, 8}},
+		}, expr.ValuelessTokens)
+	})
+
+	t.Run("conditional expression : binary expression test", func(t *testing.T) {
+		n := MustParseModule("(1 + 2 ? 3 : 4)")
+		expr := n.Statements[0].(*ConditionalExpression)
+
+		assert.Nil(t, expr.Err)
+		assert.Equal(t, NodeSpan{0, 15}, expr.Span)
+		if assert.IsType(t, &BinaryExpression{}, expr.Test) {
+			test := expr.Test.(*BinaryExpression)
+			assert.Equal(t, Add, test.Operator)
+			assert.Equal(t, NodeSpan{1, 6}, test.Span)
+		}
+		assert.Equal(t, NodeSpan{9, 10}, expr.Consequent.Base().Span)
+		assert.Equal(t, NodeSpan{13, 14}, expr.Alternate.Base().Span)
+	})
+
+	t.Run("conditional expression : boolean conversions are still parsed", func(t *testing.T) {
+		n := MustParseModule("($a? and $b?)")
+		expr := n.Statements[0].(*BinaryExpression)
+
+		assert.Nil(t, expr.Err)
+		assert.IsType(t, &BooleanConversionExpression{}, expr.Left)
+		assert.IsType(t, &BooleanConversionExpression{}, expr.Right)
+	})
+
+	t.Run("conditional expression : missing alternate", func(t *testing.T) {
+		n, err := ParseModule("($a ? 1)", "")
+		assert.Error(t, err)
+
+		expr := n.Statements[0].(*ConditionalExpression)
+		assert.Equal(t, NodeSpan{0, 7}, expr.Span)
+		assert.Nil(t, expr.Alternate)
+		assert.Equal(t, "unterminated conditional expression: missing ':' after consequent", expr.Err.Message)
+	})
+
+	t.Run("conditional expression : missing closing parenthesis", func(t *testing.T) {
+		n, err := ParseModule("($a ? 1 : 2", "")
+		assert.Error(t, err)
+
+		expr := n.Statements[0].(*ConditionalExpression)
+		assert.Equal(t, NodeSpan{0, 11}, expr.Span)
+		assert.Equal(t, "unterminated conditional expression: missing closing parenthesis", expr.Err.Message)
+	})
+
 	t.Run("binary expression : missing right operand", func(t *testing.T) {
 		n, err := ParseModule("($a +)", "")
 		assert.Error(t, err)
@@ -4918,6 +5510,18 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("spawn expression : embedded module with requirements on the next line", func(t *testing.T) {
+		n := MustParseModule(`
+			sr nil {
+				require {}
+			}
+		`)
+		spawnExpr := n.Statements[0].(*SpawnExpression)
+		embeddedMod := spawnExpr.ExprOrVar.(*EmbeddedModule)
+		assert.NotNil(t, embeddedMod.Requirements)
+		assert.Empty(t, embeddedMod.Statements)
+	})
+
 	t.Run("spawn expression : embedded module", func(t *testing.T) {
 		n := MustParseModule(`sr nil { require {} }`)
 		assert.EqualValues(t, &Module{
@@ -5134,6 +5738,45 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("return statement : several values", func(t *testing.T) {
+		n := MustParseModule("return 1, 2")
+
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{
+				NodeSpan{0, 11},
+				nil,
+				nil,
+			},
+			Statements: []Node{
+				&ReturnStatement{
+					NodeBase: NodeBase{
+						NodeSpan{0, 11},
+						nil,
+						[]Token{{RETURN_KEYWORD, NodeSpan{0, 6}}},
+					},
+					Values: []Node{
+						&IntLiteral{
+							NodeBase: NodeBase{NodeSpan{7, 8}, nil, nil},
+							Raw:      "1",
+							Value:    1,
+						},
+						&IntLiteral{
+							NodeBase: NodeBase{NodeSpan{10, 11}, nil, nil},
+							Raw:      "2",
+							Value:    2,
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("return statement : several values, missing value after comma", func(t *testing.T) {
+		assert.Panics(t, func() {
+			MustParseModule("return 1,")
+		})
+	})
+
 	t.Run("boolean conversion expression", func(t *testing.T) {
 		n := MustParseModule("$err?")
 
@@ -5199,6 +5842,30 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("single line closed object pattern literal { : integer}! ", func(t *testing.T) {
+		n := MustParseModule("%{ : 1 }!")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 9}, nil, nil},
+			Statements: []Node{
+				&ObjectPatternLiteral{
+					NodeBase: NodeBase{NodeSpan{0, 9}, nil, nil},
+					Properties: []ObjectProperty{
+						{
+							NodeBase: NodeBase{NodeSpan{3, 6}, nil, nil},
+							Key:      nil,
+							Value: &IntLiteral{
+								NodeBase: NodeBase{NodeSpan{5, 6}, nil, nil},
+								Raw:      "1",
+								Value:    1,
+							},
+						},
+					},
+					Closed: true,
+				},
+			},
+		}, n)
+	})
+
 	t.Run("single line object pattern literal [ integer ] ", func(t *testing.T) {
 		n := MustParseModule("%[ 1 ]")
 		assert.EqualValues(t, &Module{
@@ -5225,38 +5892,102 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
-	t.Run("pattern definition : RHS is a pattern identifier literal ", func(t *testing.T) {
-		n := MustParseModule("%i = %int;")
+	t.Run("single line list pattern literal [ integer, rest ] ", func(t *testing.T) {
+		n := MustParseModule("%[ 1, ...2 ]")
 		assert.EqualValues(t, &Module{
-			NodeBase: NodeBase{NodeSpan{0, 10}, nil, nil},
+			NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
 			Statements: []Node{
-				&PatternDefinition{
+				&ListPatternLiteral{
 					NodeBase: NodeBase{
-						NodeSpan{0, 10},
-						nil,
+						NodeSpan{0, 12},
 						nil,
+						[]Token{
+							{OPENING_BRACKET, NodeSpan{1, 2}},
+							{CLOSING_BRACKET, NodeSpan{11, 12}},
+						},
 					},
-					Left: &PatternIdentifierLiteral{
-						NodeBase: NodeBase{NodeSpan{0, 2}, nil, nil},
-						Name:     "i",
+					Elements: []Node{
+						&IntLiteral{
+							NodeBase: NodeBase{NodeSpan{3, 4}, nil, nil},
+							Raw:      "1",
+							Value:    1,
+						},
 					},
-					Right: &PatternIdentifierLiteral{
-						NodeBase: NodeBase{NodeSpan{5, 9}, nil, nil},
-						Name:     "int",
+					HasRest: true,
+					Rest: &IntLiteral{
+						NodeBase: NodeBase{NodeSpan{9, 10}, nil, nil},
+						Raw:      "2",
+						Value:    2,
 					},
 				},
 			},
 		}, n)
 	})
 
-	t.Run("pattern definition : RHS is an object pattern literal ", func(t *testing.T) {
-		n := MustParseModule("%i = %{ : 1 };")
+	t.Run("single line list pattern literal [ integer, rest without matcher ] ", func(t *testing.T) {
+		n := MustParseModule("%[1, ...]")
 		assert.EqualValues(t, &Module{
-			NodeBase: NodeBase{NodeSpan{0, 14}, nil, nil},
+			NodeBase: NodeBase{NodeSpan{0, 9}, nil, nil},
 			Statements: []Node{
-				&PatternDefinition{
+				&ListPatternLiteral{
 					NodeBase: NodeBase{
-						NodeSpan{0, 14},
+						NodeSpan{0, 9},
+						nil,
+						[]Token{
+							{OPENING_BRACKET, NodeSpan{1, 2}},
+							{CLOSING_BRACKET, NodeSpan{8, 9}},
+						},
+					},
+					Elements: []Node{
+						&IntLiteral{
+							NodeBase: NodeBase{NodeSpan{2, 3}, nil, nil},
+							Raw:      "1",
+							Value:    1,
+						},
+					},
+					HasRest: true,
+				},
+			},
+		}, n)
+	})
+
+	t.Run("list pattern literal : the rest element is not the last element", func(t *testing.T) {
+		_, err := ParseModule("%[...1, 2]", "")
+		assert.Error(t, err)
+	})
+
+	t.Run("pattern definition : RHS is a pattern identifier literal ", func(t *testing.T) {
+		n := MustParseModule("%i = %int;")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 10}, nil, nil},
+			Statements: []Node{
+				&PatternDefinition{
+					NodeBase: NodeBase{
+						NodeSpan{0, 10},
+						nil,
+						nil,
+					},
+					Left: &PatternIdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{0, 2}, nil, nil},
+						Name:     "i",
+					},
+					Right: &PatternIdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{5, 9}, nil, nil},
+						Name:     "int",
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("pattern definition : RHS is an object pattern literal ", func(t *testing.T) {
+		n := MustParseModule("%i = %{ : 1 };")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 14}, nil, nil},
+			Statements: []Node{
+				&PatternDefinition{
+					NodeBase: NodeBase{
+						NodeSpan{0, 14},
 						nil,
 						nil,
 					},
@@ -5321,6 +6052,50 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("pattern definition : RHS is a single element pattern of kind int : element is an integer literal with '*' as ocurrence", func(t *testing.T) {
+		n := MustParseModule("%n = int 1*;")
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 12}, nil, nil},
+			Statements: []Node{
+				&PatternDefinition{
+					NodeBase: NodeBase{
+						NodeSpan{0, 12},
+						nil,
+						nil,
+					},
+					Left: &PatternIdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{0, 2}, nil, nil},
+						Name:     "n",
+					},
+					Right: &PatternPiece{
+						NodeBase: NodeBase{NodeSpan{5, 11}, nil, nil},
+						Kind:     IntegerPattern,
+						Elements: []*PatternPieceElement{
+							{
+								NodeBase: NodeBase{
+									NodeSpan{9, 11},
+									nil,
+									nil,
+								},
+								Ocurrence: ZeroOrMoreOcurrence,
+								Expr: &IntLiteral{
+									NodeBase: NodeBase{NodeSpan{9, 10}, nil, nil},
+									Raw:      "1",
+									Value:    1,
+								},
+							},
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("pattern definition : RHS is a pattern of kind string with an invalid element", func(t *testing.T) {
+		_, err := ParseModule("%n = string ];", "")
+		assert.Error(t, err)
+	})
+
 	t.Run("pattern definition : RHS is a single element pattern of kind string : element is a rune literal", func(t *testing.T) {
 		n := MustParseModule("%l = string 'a';")
 		assert.EqualValues(t, &Module{
@@ -5514,6 +6289,54 @@ func TestMustParseModule(t *testing.T) {
 		}, n)
 	})
 
+	t.Run("pattern definition : RHS is a single element pattern of kind string : element is a string literal with '={2,4}' as ocurrence", func(t *testing.T) {
+		n := MustParseModule(`%l = string "a"={2,4};`)
+		assert.EqualValues(t, &Module{
+			NodeBase: NodeBase{NodeSpan{0, 22}, nil, nil},
+			Statements: []Node{
+				&PatternDefinition{
+					NodeBase: NodeBase{
+						NodeSpan{0, 22},
+						nil,
+						nil,
+					},
+					Left: &PatternIdentifierLiteral{
+						NodeBase: NodeBase{NodeSpan{0, 2}, nil, nil},
+						Name:     "l",
+					},
+					Right: &PatternPiece{
+						NodeBase: NodeBase{NodeSpan{5, 21}, nil, nil},
+						Kind:     StringPattern,
+						Elements: []*PatternPieceElement{
+							{
+								Ocurrence:         RangeOcurrence,
+								MinOcurrenceCount: 2,
+								MaxOcurrenceCount: 4,
+								NodeBase: NodeBase{
+									NodeSpan{12, 21},
+									nil,
+									nil,
+								},
+								Expr: &StringLiteral{
+									NodeBase: NodeBase{NodeSpan{12, 15}, nil, nil},
+									Raw:      `"a"`,
+									Value:    "a",
+								},
+							},
+						},
+					},
+				},
+			},
+		}, n)
+	})
+
+	t.Run("pattern definition : RHS is a single element pattern of kind string with an invalid ocurrence range", func(t *testing.T) {
+		for _, code := range []string{`%l = string "a"={4,2};`, `%l = string "a"={2};`, `%l = string "a"={2,`} {
+			_, err := ParseModule(code, "")
+			assert.Error(t, err, code)
+		}
+	})
+
 	t.Run("pattern definition : RHS is a two-case union with one element each", func(t *testing.T) {
 		n := MustParseModule(`%i = | "a" | "b";`)
 		assert.EqualValues(t, &Module{
@@ -6021,10 +6844,159 @@ func (user User) GetNameNoCtx() string {
 	return user.Name
 }
 
+func (user User) Copy(ctx *Context) *User {
+	userCopy := user
+	return &userCopy
+}
+
 func ctxlessFunc() int {
 	return 3
 }
 
+func statefulFunc(state *State) interface{} {
+	return state.GlobalScope()["a"]
+}
+
+func TestHighlightSpans(t *testing.T) {
+	src := "# fetch\n" +
+		"const (\n  URL = https://example.com/\n)\n" +
+		"if (1 + 2.5) {\n  return [\"a\", ./a.txt, /tmp/...] # done\n}\n" +
+		"for i, e in $$x { break }"
+
+	type categorizedText struct {
+		text     string
+		category HighlightCategory
+	}
+
+	var actual []categorizedText
+	runes := []rune(src)
+	for _, span := range HighlightSpans(src) {
+		actual = append(actual, categorizedText{string(runes[span.Span.Start:span.Span.End]), span.Category})
+	}
+
+	assert.Equal(t, []categorizedText{
+		{"# fetch", CommentHighlight},
+		{"const", KeywordHighlight},
+		{"https://example.com/", URLHighlight},
+		{"if", KeywordHighlight},
+		{"1", NumberHighlight},
+		{"+", OperatorHighlight},
+		{"2.5", NumberHighlight},
+		{"return", KeywordHighlight},
+		{"\"a\"", StringHighlight},
+		{"./a.txt", PathHighlight},
+		{"/tmp/...", PathHighlight},
+		{"# done", CommentHighlight},
+		{"for", KeywordHighlight},
+		{"in", KeywordHighlight},
+		{"break", KeywordHighlight},
+	}, actual)
+
+	t.Run("sharp sign in a string literal", func(t *testing.T) {
+		spans := HighlightSpans(`"# a"`)
+		assert.Equal(t, []HighlightSpan{{Span: NodeSpan{0, 5}, Category: StringHighlight}}, spans)
+	})
+}
+
+func TestCheckWarnings(t *testing.T) {
+
+	t.Run("clean block", func(t *testing.T) {
+		n := MustParseModule(`
+			fn f(){
+				a = 1
+				return $a
+			}
+		`)
+		assert.Empty(t, CheckWarnings(n))
+	})
+
+	t.Run("unreachable code after return", func(t *testing.T) {
+		src := "fn f(){ return 1; a = 1; b = 2 }"
+		n := MustParseModule(src)
+		diagnostics := CheckWarnings(n)
+
+		if !assert.Len(t, diagnostics, 1) {
+			return
+		}
+		assert.Equal(t, WarningSeverity, diagnostics[0].Severity)
+		assert.Equal(t, NodeSpan{18, 30}, diagnostics[0].Span)
+		assert.Equal(t, 18, diagnostics[0].Index)
+		assert.Equal(t, "unreachable code after return statement", diagnostics[0].Message)
+	})
+
+	t.Run("unreachable code after break & continue", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [1] {
+				if true {
+					continue
+					a = 1
+				}
+				break
+				b = 1
+			}
+		`)
+		diagnostics := CheckWarnings(n)
+
+		if !assert.Len(t, diagnostics, 2) {
+			return
+		}
+		assert.Equal(t, "unreachable code after break statement", diagnostics[0].Message)
+		assert.Equal(t, "unreachable code after continue statement", diagnostics[1].Message)
+	})
+
+	t.Run("unreachable code at the top level of a module", func(t *testing.T) {
+		n := MustParseModule("return 1\na = 1")
+		assert.Len(t, CheckWarnings(n), 1)
+		assert.NoError(t, Check(n))
+	})
+}
+
+func TestParseModuleWithDiagnostics(t *testing.T) {
+
+	t.Run("no errors", func(t *testing.T) {
+		mod, diagnostics := ParseModuleWithDiagnostics("a = 1", "")
+		assert.NotNil(t, mod)
+		assert.Empty(t, diagnostics)
+	})
+
+	t.Run("two independent syntax errors", func(t *testing.T) {
+		src := "a = 1 ]\nb = 2 ]\n"
+		mod, diagnostics := ParseModuleWithDiagnostics(src, "")
+		assert.NotNil(t, mod)
+
+		if !assert.Len(t, diagnostics, 2) {
+			return
+		}
+
+		assert.Equal(t, NodeSpan{5, 6}, diagnostics[0].Span)
+		assert.Equal(t, 6, diagnostics[0].Index)
+		assert.Equal(t, NodeSpan{13, 14}, diagnostics[1].Span)
+		assert.Equal(t, 14, diagnostics[1].Index)
+
+		for _, diagnostic := range diagnostics {
+			assert.Equal(t, ErrorSeverity, diagnostic.Severity)
+			assert.Contains(t, diagnostic.Message, "an expression was expected")
+		}
+
+		_, err := ParseModule(src, "mod.gos")
+		assert.Contains(t, err.Error(), "mod.gos:1:7: ")
+		assert.Contains(t, err.Error(), "mod.gos:2:7: ")
+	})
+
+	t.Run("non-syntax error", func(t *testing.T) {
+		src := "$a = require"
+		mod, diagnostics := ParseModuleWithDiagnostics(src, "")
+		assert.Nil(t, mod)
+
+		if !assert.Len(t, diagnostics, 1) {
+			return
+		}
+
+		assert.Equal(t, NodeSpan{0, len(src)}, diagnostics[0].Span)
+		assert.Equal(t, "require is a keyword, it cannot be used as an identifier", diagnostics[0].Message)
+	})
+}
+
 func TestCheck(t *testing.T) {
 
 	t.Run("object literal with two implict keys", func(t *testing.T) {
@@ -6045,6 +7017,43 @@ func TestCheck(t *testing.T) {
 		assert.Error(t, Check(n.Statements[0]))
 	})
 
+	t.Run("object literal with an invalid key node", func(t *testing.T) {
+		n := &ObjectLiteral{
+			Properties: []ObjectProperty{
+				{Key: &BooleanLiteral{Value: true}, Value: &IntLiteral{Value: 1}},
+			},
+		}
+		assert.NotPanics(t, func() {
+			assert.Error(t, Check(n))
+		})
+	})
+
+	t.Run("object pattern literal with an invalid key node", func(t *testing.T) {
+		n := &ObjectPatternLiteral{
+			Properties: []ObjectProperty{
+				{Key: &IntLiteral{Value: 1}, Value: &IntLiteral{Value: 1}},
+			},
+		}
+		assert.NotPanics(t, func() {
+			assert.Error(t, Check(n))
+		})
+	})
+
+	t.Run("constant declaration with a literal value", func(t *testing.T) {
+		n := MustParseModule(`const ( a = 1 )`)
+		assert.NoError(t, Check(n))
+	})
+
+	t.Run("constant declaration whose value is an identifier", func(t *testing.T) {
+		n := MustParseModule(`const ( a = b )`)
+		assert.Error(t, Check(n))
+	})
+
+	t.Run("self-referential constant declaration", func(t *testing.T) {
+		n := MustParseModule(`const ( a = a )`)
+		assert.Error(t, Check(n))
+	})
+
 	t.Run("object literal with duplicate keys in same multi-key definition", func(t *testing.T) {
 		n := MustParseModule(`{a,a:1}`)
 		assert.Error(t, Check(n.Statements[0]))
@@ -6094,6 +7103,29 @@ func TestCheck(t *testing.T) {
 		assert.Error(t, Check(n))
 	})
 
+	t.Run("constant declarations in an embedded module", func(t *testing.T) {
+		n := MustParseModule(`
+			sr nil {
+				const ( a = 1 )
+				return 1
+			}
+		`)
+		err := Check(n)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "embedded modules cannot declare constants")
+		}
+
+		_, err = Eval(n, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+
+	t.Run("embedded module starting with a call of a function whose name starts with 'const'", func(t *testing.T) {
+		n := MustParseModule(`sr nil { constants() }`)
+		emod := n.Statements[0].(*SpawnExpression).ExprOrVar.(*EmbeddedModule)
+		assert.IsType(t, &Call{}, emod.Statements[0])
+		assert.NoError(t, Check(n))
+	})
+
 	t.Run("function with same name in an embedded module", func(t *testing.T) {
 		n := MustParseModule(`
 			fn f(){}
@@ -6170,6 +7202,39 @@ func TestCheck(t *testing.T) {
 		assert.Error(t, Check(n))
 	})
 
+	t.Run("break statement : pipeline stage in a for statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for e in [1] {
+				f 1 | break
+			}
+		`)
+		err := Check(n)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "break statements are not allowed in pipeline stages")
+		}
+	})
+
+	t.Run("continue statement : pipeline stage of a pipeline expression in a for statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for e in [1] {
+				$a = | f 1 | continue
+			}
+		`)
+		err := Check(n)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "continue statements are not allowed in pipeline stages")
+		}
+	})
+
+	t.Run("pipeline statement in a for statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for e in [1] {
+				f 1 | g
+			}
+		`)
+		assert.NoError(t, Check(n))
+	})
+
 	t.Run("local variable in a module : undefined", func(t *testing.T) {
 		n := MustParseModule(`
 			$a
@@ -6222,6 +7287,23 @@ func TestCheck(t *testing.T) {
 		assert.NoError(t, Check(n))
 	})
 
+	t.Run("function with distinct parameter names", func(t *testing.T) {
+		n := MustParseModule(`
+			fn f(a, b){}
+		`)
+		assert.NoError(t, Check(n))
+	})
+
+	t.Run("function with duplicate parameter names", func(t *testing.T) {
+		n := MustParseModule(`
+			fn f(a, b, a){}
+		`)
+		err := Check(n)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "'a'")
+		}
+	})
+
 	t.Run("argument variable in a function", func(t *testing.T) {
 		n := MustParseModule(`
 			fn f(a){
@@ -6231,17 +7313,145 @@ func TestCheck(t *testing.T) {
 		assert.NoError(t, Check(n))
 	})
 
-}
+	t.Run("for statement variables in the body", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {
+				$i; $e
+			}
+		`)
+		assert.NoError(t, Check(n))
+	})
 
-func TestRequirements(t *testing.T) {
+	t.Run("for statement variable after the statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {}
+			$e
+		`)
+		assert.Error(t, Check(n))
+	})
 
-	testCases := []struct {
-		name                string
-		inputModule         string
-		expectedPermissions []Permission
-		expectedLimitations []Limitation
-	}{
-		{"empty requirements", `require {}`, []Permission{}, []Limitation{}},
+	t.Run("for statement variable in the iterated value", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in $e {}
+		`)
+		assert.Error(t, Check(n))
+	})
+
+	t.Run("for statement variable in a nested for statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {
+				for e2 in [] {
+					$e; $e2
+				}
+				$e2
+			}
+		`)
+		assert.Error(t, Check(n))
+	})
+
+	t.Run("assignment of a for statement variable in the body", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {
+				$e = 1
+			}
+		`)
+		err := Check(n)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "iteration variable")
+		}
+
+		n = MustParseModule(`
+			for i, e in [] {
+				i = 1
+			}
+		`)
+		assert.Error(t, Check(n))
+
+		n = MustParseModule(`
+			for i, e in [] {
+				if true {
+					$i = 1
+				}
+			}
+		`)
+		assert.Error(t, Check(n))
+	})
+
+	t.Run("reading a for statement variable and assigning another variable in the body", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {
+				$a = $e
+				$b = ($i + 1)
+			}
+		`)
+		assert.NoError(t, Check(n))
+	})
+
+	t.Run("assignment of a variable named after a for statement variable after the statement", func(t *testing.T) {
+		n := MustParseModule(`
+			for i, e in [] {}
+			$e = 1
+		`)
+		assert.NoError(t, Check(n))
+	})
+
+}
+
+func TestCheckModuleStatic(t *testing.T) {
+
+	newContext := func() *Context {
+		return NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			HttpPermission{ReadPerm, HTTPHostPattern("https://*.com")},
+		}, nil, nil)
+	}
+
+	t.Run("permitted import", func(t *testing.T) {
+		mod := MustParseModule(`
+			import a https://modules.com/a.gos "` + RETURN_GLOBAL_A_MODULE_HASH + `" {a: 1} allow {read: {globals: "a"}}
+		`)
+		assert.NoError(t, CheckModuleStatic(mod, newContext()))
+	})
+
+	t.Run("forbidden import URL", func(t *testing.T) {
+		mod := MustParseModule(`
+			import a https://modules.org/a.gos "` + RETURN_1_MODULE_HASH + `" {} allow {}
+		`)
+		err := CheckModuleStatic(mod, newContext())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "import a")
+		}
+	})
+
+	t.Run("granted permission not held by the context", func(t *testing.T) {
+		mod := MustParseModule(`
+			import a https://modules.com/a.gos "` + RETURN_1_MODULE_HASH + `" {} allow {read: https://example.org/}
+		`)
+		err := CheckModuleStatic(mod, newContext())
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "cannot allow permission")
+		}
+	})
+
+	t.Run("imports are disabled", func(t *testing.T) {
+		mod := MustParseModule(`
+			import a https://modules.com/a.gos "` + RETURN_1_MODULE_HASH + `" {} allow {}
+		`)
+		ctx := newContext()
+		ctx.DisableImports()
+		assert.Error(t, CheckModuleStatic(mod, ctx))
+	})
+}
+
+func TestRequirements(t *testing.T) {
+
+	testCases := []struct {
+		name                string
+		inputModule         string
+		expectedPermissions []Permission
+		expectedLimitations []Limitation
+	}{
+		{"empty requirements", `require {}`, []Permission{}, []Limitation{}},
 		{"read_any_global", `require { read: {globals: "*"} }`, []Permission{
 			GlobalVarPermission{ReadPerm, "*"},
 		}, []Limitation{}},
@@ -6276,6 +7486,43 @@ func TestRequirements(t *testing.T) {
 			ContextlessCallPermission{ReceiverTypeName: "", FuncMethodName: "f"},
 			ContextlessCallPermission{ReceiverTypeName: "User", FuncMethodName: "Name"},
 		}, []Limitation{}},
+		{"call_stateful_funcs", `
+			require { 
+				use: {
+					stateful: [f, g]
+				}
+			}
+		`, []Permission{
+			StatefulCallPermission{FuncMethodName: "f"},
+			StatefulCallPermission{FuncMethodName: "g"},
+		}, []Limitation{}},
+		{"use_commands_with_wildcards", `
+			require { 
+				use: {
+					commands: {
+						git: {
+							"*": {}
+							remote: {"...": {}}
+						}
+						ls: {"...": {}}
+					}
+				}
+			}
+		`, []Permission{
+			CommandPermission{CommandName: "git", SubcommandNameChain: []string{"*"}},
+			CommandPermission{CommandName: "git", SubcommandNameChain: []string{"remote", "..."}},
+			CommandPermission{CommandName: "ls", SubcommandNameChain: []string{"..."}},
+		}, []Limitation{}},
+		{"provide_and_consume_topics", `
+			require { 
+				provide: {topics: "news"}
+				consume: {topics: ["news", "weather"]}
+			}
+		`, []Permission{
+			TopicPermission{ProvidePerm, "news"},
+			TopicPermission{ConsumePerm, "news"},
+			TopicPermission{ConsumePerm, "weather"},
+		}, []Limitation{}},
 		{"limitations", `
 			require { 
 				limits: {
@@ -6287,6 +7534,17 @@ func TestRequirements(t *testing.T) {
 			{Name: "http/upload", ByteRate: ByteRate(100_000)},
 			{Name: "fs/new-file", SimpleRate: SimpleRate(100)},
 		}},
+		{"host_qualified_limitations", `
+			require { 
+				limits: {
+					"http/download@*.example.com": 100kB/s
+					"http/request@https://example.org": 10x/s
+				}
+			}
+		`, []Permission{}, []Limitation{
+			{Name: "http/download@*.example.com", ByteRate: ByteRate(100_000)},
+			{Name: "http/request@https://example.org", SimpleRate: SimpleRate(10)},
+		}},
 	}
 
 	for _, testCase := range testCases {
@@ -6300,6 +7558,74 @@ func TestRequirements(t *testing.T) {
 
 }
 
+func TestRequirementsHostAliases(t *testing.T) {
+
+	newState := func() *State {
+		ctx := NewContext(nil, nil, nil)
+		ctx.addHostAlias("api", HTTPHost("https://example.com"))
+		return NewState(ctx)
+	}
+
+	t.Run("URL expression", func(t *testing.T) {
+		mod := MustParseModule(`require { read: @api/users }`)
+		perms, _ := mod.Requirements.Object.PermissionsLimitations(nil, newState(), nil, nil)
+		assert.EqualValues(t, []Permission{HttpPermission{ReadPerm, URL("https://example.com/users")}}, perms)
+	})
+
+	t.Run("URL expression with a query", func(t *testing.T) {
+		mod := MustParseModule(`require { read: @api/users?limit=10 }`)
+		perms, _ := mod.Requirements.Object.PermissionsLimitations(nil, newState(), nil, nil)
+		assert.EqualValues(t, []Permission{HttpPermission{ReadPerm, URL("https://example.com/users?limit=10")}}, perms)
+	})
+
+	t.Run("undefined alias", func(t *testing.T) {
+		mod := MustParseModule(`require { read: @other/users }`)
+		assert.Panics(t, func() {
+			mod.Requirements.Object.PermissionsLimitations(nil, newState(), nil, nil)
+		})
+	})
+}
+
+func TestDescribeRequirements(t *testing.T) {
+
+	t.Run("HTTP permissions & limits", func(t *testing.T) {
+		mod := MustParseModule(`
+			require { 
+				read: https://example.com/
+				create: https://example.com/users
+				limits: {
+					"http/upload": 100kB/s
+					"http/request": 10x/s
+					"execution/total-time": 1s
+				}
+			}
+		`)
+		description, err := mod.DescribeRequirements()
+		assert.NoError(t, err)
+		assert.Equal(t, "permissions:\n"+
+			"  read:\n"+
+			"    [read https://example.com/]\n"+
+			"  create:\n"+
+			"    [create https://example.com/users]\n"+
+			"limits:\n"+
+			"  http/upload: 100kB/s\n"+
+			"  http/request: 10x/s\n"+
+			"  execution/total-time: 1s\n", description)
+	})
+
+	t.Run("no requirements", func(t *testing.T) {
+		description, err := MustParseModule("").DescribeRequirements()
+		assert.NoError(t, err)
+		assert.Empty(t, description)
+	})
+
+	t.Run("invalid requirements", func(t *testing.T) {
+		mod := MustParseModule(`require { limits: { "execution/total-time": 100x/s } }`)
+		_, err := mod.DescribeRequirements()
+		assert.Error(t, err)
+	})
+}
+
 func NewDefaultTestContext() *Context {
 	return NewContext([]Permission{
 		GlobalVarPermission{ReadPerm, "*"},
@@ -6312,6 +7638,17 @@ func NewDefaultTestContext() *Context {
 	}, nil, nil)
 }
 
+// handlerTransport is an http.RoundTripper that passes the requests to a handler instead of using the network.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (transport handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	transport.handler.ServeHTTP(recorder, req)
+	return recorder.Result(), nil
+}
+
 func TestEval(t *testing.T) {
 
 	t.Run("integer literal", func(t *testing.T) {
@@ -6321,6 +7658,54 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, 1, res)
 	})
 
+	t.Run("integer arithmetic", func(t *testing.T) {
+		testCases := []struct {
+			code   string
+			result int
+		}{
+			{"(1 + 2)", 3},
+			{"(1 - 2)", -1},
+			{"(2 * 3)", 6},
+			{"(6 / 3)", 2},
+			{"(1 + 2 * 3)", 7},
+			{"(2 * 3 + 1)", 7},
+			{"(10 - 3 - 2)", 5},
+			{"(12 / 2 / 3)", 2},
+			{"((1 + 2) * 3)", 9},
+			{"(1 + 2 * 3 - 4 / 2)", 5},
+			{"(2000000000 + 147483647)", math.MaxInt32},
+			{"(0 - 2000000000)", -2000000000},
+		}
+
+		for _, testCase := range testCases {
+			n := MustParseModule(testCase.code)
+			res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext()))
+			assert.NoError(t, err, testCase.code)
+			assert.EqualValues(t, testCase.result, res, testCase.code)
+		}
+	})
+
+	t.Run("integer arithmetic : overflow", func(t *testing.T) {
+		for _, code := range []string{
+			"(2000000000 + 2000000000)",
+			"((0 - 2000000000) - 2000000000)",
+			"(100000 * 100000)",
+		} {
+			n := MustParseModule(code)
+			_, err := Eval(n.Statements[0], NewState(NewDefaultTestContext()))
+			assert.ErrorContains(t, err, "integer overflow", code)
+		}
+	})
+
+	t.Run("integer arithmetic : operand from Go that does not fit in 32 bits", func(t *testing.T) {
+		n := MustParseModule("($$a + 1)")
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"a": math.MaxInt64,
+		})
+		_, err := Eval(n.Statements[0], state)
+		assert.ErrorContains(t, err, "integer overflow")
+	})
+
 	t.Run("string literal", func(t *testing.T) {
 		n := MustParseModule(`"a"`)
 		res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext()))
@@ -6447,6 +7832,24 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, Path("./home/foo"), res)
 	})
 
+	t.Run("absolute path expression : escaped dollar sign", func(t *testing.T) {
+		n := MustParseModule(`/home/$username$/a\$b`)
+		res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext(), map[string]interface{}{
+			"username": "foo",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, Path("/home/foo/a$b"), res)
+	})
+
+	t.Run("relative path expression : escaped dollar sign", func(t *testing.T) {
+		n := MustParseModule(`./a\$b/$username$`)
+		res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext(), map[string]interface{}{
+			"username": "foo",
+		}))
+		assert.NoError(t, err)
+		assert.Equal(t, Path("./a$b/foo"), res)
+	})
+
 	t.Run("HTTP host", func(t *testing.T) {
 		n := MustParseModule(`https://example.com`)
 		res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext()))
@@ -6479,6 +7882,50 @@ func TestEval(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, URL("https://example.com/index.html"), res)
 	})
+
+	t.Run("URL expression : host alias defined in the script", func(t *testing.T) {
+		n := MustParseModule(`
+			@api = https://example.com
+			return @api/index.html
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		assert.NoError(t, err)
+		assert.Equal(t, URL("https://example.com/index.html"), res)
+	})
+
+	t.Run("URL expression : host alias with a denied host", func(t *testing.T) {
+		n := MustParseModule(`@api/index.html`)
+		ctx := NewContext([]Permission{
+			HttpPermission{ReadPerm, HTTPHost("https://example.com")},
+		}, nil, nil)
+		ctx.addHostAlias("api", HTTPHost("https://example.org"))
+		res, err := Eval(n.Statements[0], NewState(ctx))
+
+		assert.Error(t, err)
+		assert.Nil(t, res)
+	})
+
+	t.Run("URL expression : host alias with a host granted for creation only", func(t *testing.T) {
+		n := MustParseModule(`@api/index.html`)
+		ctx := NewContext([]Permission{
+			HttpPermission{CreatePerm, HTTPHost("https://example.com")},
+		}, nil, nil)
+		ctx.addHostAlias("api", HTTPHost("https://example.com"))
+		res, err := Eval(n.Statements[0], NewState(ctx))
+
+		assert.NoError(t, err)
+		assert.Equal(t, URL("https://example.com/index.html"), res)
+	})
+
+	t.Run("URL expression : undefined host alias", func(t *testing.T) {
+		n := MustParseModule(`@api/index.html`)
+		res, err := Eval(n.Statements[0], NewState(NewDefaultTestContext()))
+
+		assert.Error(t, err)
+		assert.Nil(t, res)
+	})
+
 	t.Run("URL expression, query with no interpolation", func(t *testing.T) {
 		n := MustParseModule(`return https://example.com/?v=a`)
 		res, err := Eval(n, NewState(NewDefaultTestContext(), nil))
@@ -6576,6 +8023,32 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, List{1}, res)
 	})
 
+	t.Run("slice mutation : replacement with the same length", func(t *testing.T) {
+		n := MustParseModule(`$a = [0, 1, 2] $a[1:3] = [3, 4]; return $a`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{0, 3, 4}, res)
+	})
+
+	t.Run("slice mutation : replacement is too short", func(t *testing.T) {
+		n := MustParseModule(`$a = [0, 1, 2] $a[0:2] = [3]; return $a`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+
+		list := List{0, 1, 2}
+		assert.Error(t, SetSlice(list, 0, 2, List{3}))
+		assert.Equal(t, List{0, 1, 2}, list)
+	})
+
+	t.Run("slice mutation : replacement is too long", func(t *testing.T) {
+		n := MustParseModule(`$a = [0, 1, 2] $a[0:1] = [3, 4]; return $a`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+	})
+
 	t.Run("member expression assignment : pre existing field", func(t *testing.T) {
 		n := MustParseModule(`$a = {count:0}; $a.count = 1; return $a.count`)
 		state := NewState(NewDefaultTestContext())
@@ -6660,6 +8133,31 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, res)
 	})
 
+	t.Run("object literal with an invalid key node", func(t *testing.T) {
+		n := &ObjectLiteral{
+			Properties: []ObjectProperty{
+				{Key: &BooleanLiteral{Value: true}, Value: &IntLiteral{Value: 1}},
+			},
+		}
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.Nil(t, res)
+		assert.ErrorContains(t, err, "invalid key type")
+	})
+
+	t.Run("object pattern literal with an invalid key node", func(t *testing.T) {
+		n := &ObjectPatternLiteral{
+			Properties: []ObjectProperty{
+				{Key: &IntLiteral{Value: 1}, Value: &IntLiteral{Value: 1}},
+			},
+		}
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.Nil(t, res)
+		assert.ErrorContains(t, err, "invalid key type")
+		assert.NotContains(t, err.Error(), "goroutine")
+	})
+
 	t.Run("object literal with a spread element", func(t *testing.T) {
 		n := MustParseModule(`o = {name: "foo"}; return { ...$o.{name} }`)
 		state := NewState(NewDefaultTestContext())
@@ -6700,6 +8198,33 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, List{1, 2}, res)
 	})
 
+	t.Run("multi assignement of the values returned by a function", func(t *testing.T) {
+		n := MustParseModule(`
+			fn f(){
+				return 1, "a"
+			}
+			assign a b = f()
+			return [$b, $a]
+		`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, List{"a", 1}, res)
+	})
+
+	t.Run("function returning several values", func(t *testing.T) {
+		n := MustParseModule(`
+			fn f(){
+				return 1, 2
+			}
+			return f()
+		`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, List{1, 2}, res)
+	})
+
 	t.Run("if statement with true condition", func(t *testing.T) {
 		n := MustParseModule(`if true { return 1 }`)
 		state := NewState(NewDefaultTestContext())
@@ -6764,18 +8289,98 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, List{1, 11}, res)
 	})
 
-	t.Run("for statement : integer range", func(t *testing.T) {
-		n := MustParseModule(`$c1 = 0; $c2 = 0; for i, e in (5 .. 6) { $c1 = ($c1 + $i); $c2 = ($c2 + $e); }; return [$c1, $c2]`)
-		state := NewState(NewDefaultTestContext())
-		res, err := Eval(n, state)
-		assert.NoError(t, err)
-		assert.EqualValues(t, List{1, 11}, res)
-	})
+	t.Run("for statement : object", func(t *testing.T) {
+		keys := List{}
+		values := List{}
 
-	t.Run("for statement : break statement", func(t *testing.T) {
 		n := MustParseModule(`
-			$c1 = 0; $c2 = 0; 
-			for i, e in (5 .. 6) { 
+			for k, v in {b: 1, a: 2, :3, :4} {
+				record $k $v
+			}
+		`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"record": func(ctx *Context, k string, v interface{}) {
+				keys = append(keys, k)
+				values = append(values, v)
+			},
+		})
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{"0", "1", "a", "b"}, keys)
+		assert.Equal(t, List{3, 4, 2, 1}, values)
+	})
+
+	t.Run("for statement : integer range", func(t *testing.T) {
+		n := MustParseModule(`$c1 = 0; $c2 = 0; for i, e in (5 .. 6) { $c1 = ($c1 + $i); $c2 = ($c2 + $e); }; return [$c1, $c2]`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, List{1, 11}, res)
+	})
+
+	t.Run("for statement : rune range", func(t *testing.T) {
+		runes := List{}
+		indexes := List{}
+
+		n := MustParseModule(`for i, r in 'a'..'c' { record $i $r }`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"record": func(ctx *Context, i int, r rune) {
+				indexes = append(indexes, i)
+				runes = append(runes, r)
+			},
+		})
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{'a', 'b', 'c'}, runes)
+		assert.Equal(t, List{0, 1, 2}, indexes)
+	})
+
+	t.Run("for statement : duration range", func(t *testing.T) {
+		durations := []time.Duration{}
+
+		n := MustParseModule(`for d in (1s .. 3s) { record $d }`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"record": func(ctx *Context, d time.Duration) {
+				durations = append(durations, d)
+			},
+		})
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, durations)
+	})
+
+	t.Run("for statement : byte count range", func(t *testing.T) {
+		counts := []ByteCount{}
+
+		n := MustParseModule(`for c in (1kB ..< 3kB) { record $c }`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"record": func(ctx *Context, c ByteCount) {
+				counts = append(counts, c)
+			},
+		})
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, []ByteCount{1_000, 2_000}, counts)
+	})
+
+	t.Run("for statement : range of non iterable quantities", func(t *testing.T) {
+		n := MustParseModule(`for c in (1kB/s .. 3kB/s) { }`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not iterable")
+		}
+	})
+
+	t.Run("range with bounds of different types", func(t *testing.T) {
+		n := MustParseModule(`return (1s .. 3kB)`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+
+	t.Run("for statement : break statement", func(t *testing.T) {
+		n := MustParseModule(`
+			$c1 = 0; $c2 = 0; 
+			for i, e in (5 .. 6) { 
 				$c1 = ($c1 + $i); 
 				if ($i == 1) { 
 					break 
@@ -6790,6 +8395,66 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, List{1, 5}, res)
 	})
 
+	t.Run("for statement : variables are not defined after the statement", func(t *testing.T) {
+		n := MustParseModule(`for i, e in [5] {}; return $e`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+		assert.NotContains(t, state.CurrentScope(), "i")
+		assert.NotContains(t, state.CurrentScope(), "e")
+	})
+
+	t.Run("for statement : variables with the same name are restored after the statement", func(t *testing.T) {
+		n := MustParseModule(`$e = 1; for e in [5] {}; return $e`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, res)
+	})
+
+	t.Run("conditional expression : true test", func(t *testing.T) {
+		n := MustParseModule(`return (true ? 1 : 2)`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, res)
+	})
+
+	t.Run("conditional expression : false test", func(t *testing.T) {
+		n := MustParseModule(`return (false ? 1 : 2)`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, res)
+	})
+
+	t.Run("conditional expression : binary expression test without spaces", func(t *testing.T) {
+		n := MustParseModule(`$a = false; return [(1 + 2 ? 3 : 4), ($a?1:2)]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{3, 2}, res)
+	})
+
+	t.Run("conditional expression : non boolean test", func(t *testing.T) {
+		n := MustParseModule(`$a = []; return ($a ? 1 : 2)`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, res)
+	})
+
+	t.Run("conditional expression : only the chosen branch is evaluated", func(t *testing.T) {
+		calls := List{}
+		n := MustParseModule(`return (true ? f(1) : f(2))`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"f": func(ctx *Context, i int) int {
+				calls = append(calls, i)
+				return i
+			},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, res)
+		assert.Equal(t, List{1}, calls)
+	})
+
 	t.Run("for <expr> statement", func(t *testing.T) {
 		n := MustParseModule(`$c = 0; for (1 .. 2) { $c = ($c + 1) }; return $c`)
 		state := NewState(NewDefaultTestContext())
@@ -6881,6 +8546,30 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, List{0, 1}, res)
 	})
 
+	t.Run("match statement : rune range matchers", func(t *testing.T) {
+		n := MustParseModule(`
+			$a = 0; 
+			$b = 0; 
+			match 'z' { 
+				'a'..'y' { $a = 1 } 
+				'z'..'z' { $b = 1} 
+			}; 
+			return [$a,$b]
+		`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{0, 1}, res)
+	})
+
+	t.Run("match expression : rune range", func(t *testing.T) {
+		n := MustParseModule(`return ('c' match 'a'..'c')`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, true, res)
+	})
+
 	t.Run("match statement : equality : two cases (second matches)", func(t *testing.T) {
 		n := MustParseModule(`$a = 0; $b = 0; match /e { /f* { $a = 1 } /e { $b = 1} }; return [$a,$b]`)
 		state := NewState(NewDefaultTestContext())
@@ -6896,6 +8585,31 @@ func TestEval(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	t.Run("match expression : undefined pattern", func(t *testing.T) {
+		n := MustParseModule(`return ({} match %o)`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.EqualError(t, err, "pattern %o is not defined")
+	})
+
+	t.Run("match expression : pattern defined by the module", func(t *testing.T) {
+		n := MustParseModule(`%o = %{}; return ({} match %o)`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, true, res)
+	})
+
+	t.Run("match expression : pattern registered by the host", func(t *testing.T) {
+		n := MustParseModule(`return ({} match %o)`)
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.WithPatterns(map[string]Matcher{"o": &ObjectPattern{}}))
+		state := NewState(ctx)
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, true, res)
+	})
+
 	t.Run("upper bound range expression : integer ", func(t *testing.T) {
 		n := MustParseModule(`return ..10`)
 		state := NewState(NewDefaultTestContext())
@@ -7137,6 +8851,30 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, "Foo", res)
 	})
 
+	t.Run("call Go function : stateful, missing permission", func(t *testing.T) {
+		n := MustParseModule(`return gofunc()`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"gofunc": statefulFunc,
+		})
+
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+	})
+
+	t.Run("call Go function : stateful, granted permission", func(t *testing.T) {
+		n := MustParseModule(`$$a = 3; return gofunc()`)
+		ctx, _ := NewDefaultTestContext().NewWith([]Permission{
+			StatefulCallPermission{FuncMethodName: "statefulFunc", ReceiverTypeName: ""},
+		})
+		state := NewState(ctx, map[string]interface{}{
+			"gofunc": statefulFunc,
+		})
+
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 3, res)
+	})
+
 	t.Run("call Go function : interface{} returned, should be wrapped and have right type", func(t *testing.T) {
 		n := MustParseModule(`
 			return (getuser()).Name
@@ -7169,6 +8907,16 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, "Foo", res)
 	})
 
+	t.Run("member of the result of a struct method", func(t *testing.T) {
+		n := MustParseModule(`return [$$user.Copy().Name, $$user.Copy().GetName()]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"user": User{"Foo", ""},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{"Foo", "Foo"}, res)
+	})
+
 	t.Run("call interface method", func(t *testing.T) {
 		n := MustParseModule(`return $$named.GetName()`)
 		state := NewState(NewDefaultTestContext(), map[string]interface{}{
@@ -7268,6 +9016,161 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, []string{"aaa", "bbb"}, UnwrapReflectVal(res))
 	})
 
+	t.Run("substrof : strings and byte slices", func(t *testing.T) {
+		n := MustParseModule(`return [("ab" substrof "cabd"), ("ab" substrof "ba"), ("ab" substrof $$bytes)]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"bytes": []byte("cabd"),
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false, true}, res)
+	})
+
+	t.Run("substrof : rune slices", func(t *testing.T) {
+		n := MustParseModule(`return [($$runes substrof "cabd"), ("ab" substrof $$runes), ("ba" substrof $$runes)]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"runes": []rune("ab"),
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, false}, res)
+	})
+
+	t.Run("substrof : identifiers and paths", func(t *testing.T) {
+		n := MustParseModule(`return [(abc substrof "abcd"), ("bc" substrof abc), ("ab" substrof /dir/ab.txt)]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, true}, res)
+	})
+
+	t.Run("substrof : unsupported operand", func(t *testing.T) {
+		n := MustParseModule(`return ("" substrof 1)`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+
+		n = MustParseModule(`return (1 substrof "")`)
+		_, err = Eval(n, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+
+	t.Run("dot : dynamic member access", func(t *testing.T) {
+		n := MustParseModule(`
+			obj = {a: 1, b: 2}
+			key = "b"
+			return [($obj . "a"), ($obj . $key), ($obj . a), ($obj . "c")]
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{1, 2, 1, nil}, res)
+	})
+
+	t.Run("dot : Go struct", func(t *testing.T) {
+		n := MustParseModule(`return ($$user . "Name")`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"user": User{Name: "Foo"},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, "Foo", res)
+	})
+
+	t.Run("dot : key that is not a string", func(t *testing.T) {
+		n := MustParseModule(`return ({a: 1} . 1)`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.ErrorAs(t, err, &TypeMismatchError{})
+	})
+
+	t.Run("nil coalescing : nil left operand", func(t *testing.T) {
+		n := MustParseModule(`obj = {a: nil}; return [(nil ?? 1), ($obj.a ?? "default")]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{1, "default"}, res)
+	})
+
+	t.Run("nil coalescing : the right operand is not evaluated if the left one is not nil", func(t *testing.T) {
+		called := false
+		n := MustParseModule(`return (0 ?? f())`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"f": func(ctx *Context) int {
+				called = true
+				return 1
+			},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, res)
+		assert.False(t, called)
+	})
+
+	t.Run("nil coalescing : chained", func(t *testing.T) {
+		n := MustParseModule(`return [(nil ?? (nil ?? 3)), ((nil ?? nil) ?? 4), (nil ?? (2 ?? 3))]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{3, 4, 2}, res)
+	})
+
+	t.Run("flags", func(t *testing.T) {
+		n := MustParseModule(`return [--no-x, --x, -n, -no-x]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{
+			Option{Name: "x", Value: false},
+			Option{Name: "x", Value: true},
+			Option{Name: "n", Value: true},
+			Option{Name: "no-x", Value: true},
+		}, res)
+	})
+
+	t.Run("keyof : object", func(t *testing.T) {
+		n := MustParseModule(`return [("a" keyof {a: 1}), ("b" keyof {a: 1})]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false}, res)
+	})
+
+	t.Run("keyof : Go struct", func(t *testing.T) {
+		n := MustParseModule(`return [("Name" keyof $$user), ("Age" keyof $$user), ("Name" keyof $$userPtr)]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"user":    User{Name: "Foo"},
+			"userPtr": &User{Name: "Foo"},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false, true}, res)
+	})
+
+	t.Run("keyof : unexported field of a Go struct", func(t *testing.T) {
+		n := MustParseModule(`return [("secret" keyof $$user), ("secret" keyof $$userPtr)]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"user":    User{Name: "Foo", secret: "bar"},
+			"userPtr": &User{Name: "Foo", secret: "bar"},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{false, false}, res)
+	})
+
+	t.Run("keyof : Go value that is not a struct", func(t *testing.T) {
+		n := MustParseModule(`return ("a" keyof $$m)`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"m": map[string]int{"a": 1},
+		})
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+	})
+
+	t.Run("keyof : external object", func(t *testing.T) {
+		n := MustParseModule(`
+			$rt = sr nil { return fn(){  return {a: 1} } }
+			$f = $rt.WaitResult()!
+			$obj = $f()
+			return [("a" keyof $obj), ("b" keyof $obj)]
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false}, res)
+	})
+
 	t.Run("member expression : <variable> <propname>", func(t *testing.T) {
 		n := MustParseModule(`$a = {v: 1}; return $a.v`)
 		state := NewState(NewDefaultTestContext())
@@ -7294,6 +9197,30 @@ func TestEval(t *testing.T) {
 		assert.Nil(t, res)
 	})
 
+	t.Run("member expression : Go map returned by a Go function", func(t *testing.T) {
+		n := MustParseModule(`$m = getmap(); return [$m.a, $m.b, $m.c]`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"getmap": func(ctx *Context) map[string]interface{} {
+				return map[string]interface{}{"a": 1, "b": nil}
+			},
+		})
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{1, nil, nil}, res)
+	})
+
+	t.Run("member expression : Go map with non-string keys", func(t *testing.T) {
+		n := MustParseModule(`$m = getmap(); return $m.a`)
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{
+			"getmap": func(ctx *Context) map[int]int {
+				return map[int]int{1: 1}
+			},
+		})
+		res, err := Eval(n, state)
+		assert.Error(t, err)
+		assert.Nil(t, res)
+	})
+
 	t.Run("extraction expression", func(t *testing.T) {
 		n := MustParseModule(`return ({a:1}).{a}`)
 		state := NewState(NewDefaultTestContext())
@@ -7367,13 +9294,141 @@ func TestEval(t *testing.T) {
 		assert.EqualValues(t, 1, res)
 	})
 
-	t.Run("spawn expression : no globals, empty embedded module", func(t *testing.T) {
-		n := MustParseModule(`
-			sr nil { }
-		`)
-		state := NewState(NewDefaultTestContext())
-		_, err := Eval(n, state)
-		assert.NoError(t, err)
+	t.Run("import statement : imports are disabled", func(t *testing.T) {
+		n := MustParseModule(strings.ReplaceAll(`
+			import importname https://modules.com/return_1.gos "<hash>" {} allow {}
+			return $$importname
+		`, "<hash>", RETURN_1_MODULE_HASH))
+		ctx := NewDefaultTestContext()
+		ctx.DisableImports()
+
+		state := NewState(ctx)
+		res, err := Eval(n, state)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "imports are disabled")
+		}
+		assert.Nil(t, res)
+	})
+
+	t.Run("import statement : imports are disabled in routines", func(t *testing.T) {
+		n := MustParseModule(strings.ReplaceAll(`
+			$rt = sr nil {
+				import importname https://modules.com/return_1.gos "<hash>" {} allow {}
+				return $$importname
+			}
+			return $rt.WaitResult()!
+		`, "<hash>", RETURN_1_MODULE_HASH))
+		ctx := NewDefaultTestContext()
+		ctx.DisableImports()
+
+		state := NewState(ctx)
+		_, err := Eval(n, state)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "imports are disabled")
+		}
+	})
+
+	t.Run("import statement : cached module", func(t *testing.T) {
+		requestCount := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestCount++
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		defer server.Close()
+
+		const HASH = "return-2-hash"
+
+		cache := NewModuleCache(1)
+		cache.Set(HASH, "return 2")
+
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{CreatePerm, "*"},
+			GlobalVarPermission{UsePerm, "*"},
+			HttpPermission{ReadPerm, URL(server.URL + "/return_1.gos")},
+			HttpPermission{ReadPerm, URL(server.URL + "/return_2.gos")},
+			RoutinePermission{CreatePerm},
+		}, nil, nil)
+		ctx.SetModuleCache(cache)
+
+		n := MustParseModule(strings.NewReplacer("<url>", server.URL, "<hash>", HASH).Replace(`
+			import importname <url>/return_2.gos "<hash>" {} allow {}
+			return $$importname
+		`))
+
+		res, err := Eval(n, NewState(ctx))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, res)
+		assert.Equal(t, 0, requestCount)
+
+		//the preseeded modules are present in every cache
+		n = MustParseModule(strings.NewReplacer("<url>", server.URL, "<hash>", RETURN_1_MODULE_HASH).Replace(`
+			import importname <url>/return_1.gos "<hash>" {} allow {}
+			return $$importname
+		`))
+
+		res, err = Eval(n, NewState(ctx))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 1, res)
+		assert.Equal(t, 0, requestCount)
+	})
+
+	t.Run("import statement : custom HTTP client", func(t *testing.T) {
+		requestedURLs := []string{}
+
+		client := &http.Client{
+			Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestedURLs = append(requestedURLs, r.URL.String())
+				w.Header().Set("Content-Type", GOPHERSCRIPT_MIMETYPE)
+				w.Write([]byte("return 3"))
+			})},
+		}
+
+		n := MustParseModule(`
+			import importname https://modules.com/return_3.gos "return-3-hash" {} allow {}
+			return $$importname
+		`)
+
+		ctx := NewDefaultTestContext()
+		ctx.SetModuleCache(NewModuleCache(1))
+		ctx.SetImportHttpClient(client)
+
+		res, err := Eval(n, NewState(ctx))
+		assert.NoError(t, err)
+		assert.EqualValues(t, 3, res)
+		assert.Equal(t, []string{"https://modules.com/return_3.gos"}, requestedURLs)
+	})
+
+	t.Run("import statement used as an expression", func(t *testing.T) {
+		n := MustParseModule(strings.ReplaceAll(`
+			$a = import importname https://modules.com/return_global_a.gos "<hash>" {a: 2} allow {read: {globals: "a"}}
+			return [($a + 1), $$importname]
+		`, "<hash>", RETURN_GLOBAL_A_MODULE_HASH))
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{3, 2}, res)
+	})
+
+	t.Run("import statement used as an expression : missing permission", func(t *testing.T) {
+		n := MustParseModule(strings.ReplaceAll(`
+			$a = import importname https://modules.com/return_1.gos "<hash>" {} allow {}
+		`, "<hash>", RETURN_1_MODULE_HASH))
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{UsePerm, "*"},
+			HttpPermission{ReadPerm, HTTPHostPattern("https://*")},
+		}, nil, nil)
+		_, err := Eval(n, NewState(ctx))
+		assert.Error(t, err)
+	})
+
+	t.Run("spawn expression : no globals, empty embedded module", func(t *testing.T) {
+		n := MustParseModule(`
+			sr nil { }
+		`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
 	})
 
 	t.Run("spawn expression : no globals, embedded module returns a simple value", func(t *testing.T) {
@@ -7421,6 +9476,64 @@ func TestEval(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("spawn expression : no globals, embedded module requires an allowed permission", func(t *testing.T) {
+		n := MustParseModule(`
+			$$URL = https://example.com/
+			$rt = sr nil { 
+				require {
+					read: $$URL
+				}
+			} allow { 
+				read: $$URL
+			}
+
+			$rt.WaitResult()!
+		`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+	})
+
+	t.Run("spawn expression : no globals, embedded module requires a permission that is not allowed", func(t *testing.T) {
+		n := MustParseModule(`
+			$$URL = https://example.com/
+			$rt = sr nil { 
+				require {
+					read: https://example.com/
+					create: https://example.com/
+				}
+			} allow { 
+				read: $$URL
+			}
+		`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "not allowed")
+		}
+	})
+
+	t.Run("spawn expression : allowing a trailing subcommand wildcard with only a single wildcard", func(t *testing.T) {
+		n := MustParseModule(`
+			$rt = sr nil { 
+
+			} allow { 
+				use: {
+					commands: {
+						git: {"...": {}}
+					}
+				}
+			}
+		`)
+		ctx, _ := NewDefaultTestContext().NewWith([]Permission{
+			CommandPermission{CommandName: "git", SubcommandNameChain: []string{"*"}},
+		})
+		_, err := Eval(n, NewState(ctx))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "cannot allow permission")
+		}
+	})
+
 	t.Run("spawn expression : no globals, group (used once)", func(t *testing.T) {
 		n := MustParseModule(`
 			sr group nil { }
@@ -7582,6 +9695,55 @@ func TestEval(t *testing.T) {
 		assert.Equal(t, ExactSimpleValueMatcher{"p"}, res)
 	})
 
+	t.Run("pattern definition : RHS is an integer pattern", func(t *testing.T) {
+		n := MustParseModule(`
+			%n = int '-'? 1 0*;
+			return [(1 match %n), (100 match %n), ((0 - 10) match %n), (0 match %n), (12 match %n), ("1" match %n), (1.0 match %n)]
+		`)
+
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, true, false, false, false, false}, res)
+	})
+
+	t.Run("pattern definition : RHS is an integer pattern with a digit range", func(t *testing.T) {
+		n := MustParseModule(`
+			%n = int '1'..'3'=2;
+			return [(12 match %n), (33 match %n), (1 match %n), (123 match %n), (14 match %n)]
+		`)
+
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, false, false, false}, res)
+	})
+
+	t.Run("pattern definition : RHS is a float pattern", func(t *testing.T) {
+		n := MustParseModule(`
+			%f = float 1 '.' 5*;
+			return [(1.5 match %f), (1.55 match %f), (1.0 match %f), (2.5 match %f), (1 match %f)]
+		`)
+
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, false, false, false}, res)
+	})
+
+	t.Run("pattern definition : RHS is a float pattern : integral float", func(t *testing.T) {
+		n := MustParseModule(`%f = float 2.0; return [(2.0 match %f), (2 match %f)]`)
+
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false}, res)
+	})
+
 	t.Run("object pattern literal : empty", func(t *testing.T) {
 		n := MustParseModule(`%{}`)
 
@@ -7647,6 +9809,182 @@ func TestEval(t *testing.T) {
 
 }
 
+func TestEvalExpression(t *testing.T) {
+
+	t.Run("literal", func(t *testing.T) {
+		res, err := EvalExpression(`"a"`, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, "a", res)
+	})
+
+	t.Run("arithmetic expression", func(t *testing.T) {
+		state := NewState(NewDefaultTestContext(), map[string]interface{}{"a": 2})
+		res, err := EvalExpression(`($$a * (1 + 2))`, state)
+		assert.NoError(t, err)
+		assert.Equal(t, 6, res)
+	})
+
+	t.Run("several statements", func(t *testing.T) {
+		_, err := EvalExpression("1\n2", NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+
+	t.Run("statement", func(t *testing.T) {
+		_, err := EvalExpression(`$a = 1`, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+}
+
+func TestCallGopherFunc(t *testing.T) {
+
+	t.Run("declared function", func(t *testing.T) {
+		n := MustParseModule(`fn add(a, b){ return ($a + $b) }`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		stackHeight := len(state.ScopeStack)
+		res, err := CallGopherFunc(state.GlobalScope()["add"].(Func), state, List{1, 2})
+		assert.NoError(t, err)
+		assert.EqualValues(t, 3, res)
+
+		//the scope of the call should have been removed
+		assert.Len(t, state.ScopeStack, stackHeight)
+	})
+
+	t.Run("function expression", func(t *testing.T) {
+		n := MustParseModule(`return fn(a){ return ($a + 1) }`)
+		state := NewState(NewDefaultTestContext())
+		fn, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		res, err := CallGopherFunc(fn.(Func), state, List{1})
+		assert.NoError(t, err)
+		assert.EqualValues(t, 2, res)
+	})
+
+	t.Run("invalid number of arguments", func(t *testing.T) {
+		n := MustParseModule(`fn add(a, b){ return ($a + $b) }`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		_, err = CallGopherFunc(state.GlobalScope()["add"].(Func), state, List{1})
+		assert.Error(t, err)
+	})
+
+	t.Run("not a function", func(t *testing.T) {
+		_, err := CallGopherFunc(&IntLiteral{Value: 1}, NewState(NewDefaultTestContext()), nil)
+		assert.ErrorAs(t, err, &NotCallableError{})
+	})
+}
+
+func TestFuncIntrospection(t *testing.T) {
+
+	t.Run("declared function", func(t *testing.T) {
+		n := MustParseModule(`fn add(a, b){ return ($a + $b) }`)
+		state := NewState(NewDefaultTestContext())
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		fn := state.GlobalScope()["add"].(Func)
+		assert.Equal(t, 2, FuncArity(fn))
+		assert.Equal(t, []string{"a", "b"}, FuncParamNames(fn))
+	})
+
+	t.Run("function expression without parameters", func(t *testing.T) {
+		n := MustParseModule(`return fn(){ return 1 }`)
+		fn, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+
+		assert.Equal(t, 0, FuncArity(fn.(Func)))
+		assert.Equal(t, []string{}, FuncParamNames(fn.(Func)))
+	})
+
+	t.Run("not a function", func(t *testing.T) {
+		assert.Equal(t, -1, FuncArity(&IntLiteral{Value: 1}))
+		assert.Nil(t, FuncParamNames(&IntLiteral{Value: 1}))
+	})
+}
+
+func TestEvalErrorTypes(t *testing.T) {
+
+	t.Run("undeclared local variable", func(t *testing.T) {
+		n := MustParseModule(`return $a`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var undefinedErr UndefinedVariableError
+		if assert.True(t, errors.As(err, &undefinedErr)) {
+			assert.Equal(t, UndefinedVariableError{Name: "a"}, undefinedErr)
+		}
+	})
+
+	t.Run("undeclared global variable", func(t *testing.T) {
+		n := MustParseModule(`return $$a`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var undefinedErr UndefinedVariableError
+		if assert.True(t, errors.As(err, &undefinedErr)) {
+			assert.Equal(t, UndefinedVariableError{Name: "a", Global: true}, undefinedErr)
+		}
+	})
+
+	t.Run("undeclared variable in a script with a name", func(t *testing.T) {
+		code := `return $a`
+		n := MustParseModule(code)
+		state := NewState(NewDefaultTestContext())
+		state.Script = []rune(code)
+		state.ScriptName = "script.gos"
+
+		_, err := Eval(n, state)
+		assert.ErrorAs(t, err, &UndefinedVariableError{})
+		assert.Contains(t, err.Error(), "variable a is not declared")
+	})
+
+	t.Run("if statement test is not a boolean", func(t *testing.T) {
+		n := MustParseModule(`if 1 { }`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var mismatchErr TypeMismatchError
+		if assert.True(t, errors.As(err, &mismatchErr)) {
+			assert.Equal(t, "bool", mismatchErr.Expected)
+			assert.Equal(t, "int", mismatchErr.Got)
+		}
+	})
+
+	t.Run("integer addition with a string operand", func(t *testing.T) {
+		n := MustParseModule(`return (1 + "a")`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var mismatchErr TypeMismatchError
+		if assert.True(t, errors.As(err, &mismatchErr)) {
+			assert.Equal(t, "int", mismatchErr.Expected)
+			assert.Equal(t, "string", mismatchErr.Got)
+		}
+	})
+
+	t.Run("float addition with an integer operand", func(t *testing.T) {
+		n := MustParseModule(`return (1.0 +. 1)`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var mismatchErr TypeMismatchError
+		if assert.True(t, errors.As(err, &mismatchErr)) {
+			assert.Equal(t, "float64", mismatchErr.Expected)
+			assert.Equal(t, "int", mismatchErr.Got)
+		}
+	})
+
+	t.Run("call of a non function", func(t *testing.T) {
+		n := MustParseModule(`$$f = 1; f()`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+
+		var notCallableErr NotCallableError
+		if assert.True(t, errors.As(err, &notCallableErr)) {
+			assert.EqualValues(t, 1, notCallableErr.Callee)
+		}
+	})
+}
+
 func TestHttpPermission(t *testing.T) {
 
 	ENTITIES := List{
@@ -7695,6 +10033,67 @@ func TestCommandPermission(t *testing.T) {
 	permSub1b := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"b"}}
 	assert.False(t, permSub1b.Includes(permSub1a))
 	assert.False(t, permSub1a.Includes(permSub1b))
+
+	permSub2ab := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"a", "b"}}
+
+	t.Run("single wildcard", func(t *testing.T) {
+		permAnySub := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"*"}}
+		assert.True(t, permAnySub.Includes(permSub1a))
+		assert.True(t, permAnySub.Includes(permSub1b))
+		assert.False(t, permAnySub.Includes(permNoSub))
+		assert.False(t, permAnySub.Includes(permSub2ab))
+		assert.False(t, permAnySub.Includes(CommandPermission{CommandName: "mycmd2", SubcommandNameChain: []string{"a"}}))
+		assert.False(t, permSub1a.Includes(permAnySub))
+
+		permAnyThenB := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"*", "b"}}
+		assert.True(t, permAnyThenB.Includes(permSub2ab))
+		assert.False(t, permAnyThenB.Includes(CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"a", "c"}}))
+	})
+
+	t.Run("trailing wildcard", func(t *testing.T) {
+		permAnyChain := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"..."}}
+		assert.True(t, permAnyChain.Includes(permNoSub))
+		assert.True(t, permAnyChain.Includes(permSub1a))
+		assert.True(t, permAnyChain.Includes(permSub2ab))
+		assert.False(t, permAnyChain.Includes(otherPermNoSub))
+
+		permAThenAnyChain := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"a", "..."}}
+		assert.True(t, permAThenAnyChain.Includes(permSub1a))
+		assert.True(t, permAThenAnyChain.Includes(permSub2ab))
+		assert.False(t, permAThenAnyChain.Includes(permSub1b))
+		assert.False(t, permAThenAnyChain.Includes(permNoSub))
+	})
+
+	t.Run("wildcards in the included permission", func(t *testing.T) {
+		permAnySub := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"*"}}
+		permAnyChain := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"..."}}
+		permAThenAnyChain := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"a", "..."}}
+		permAnySubThenAnyChain := CommandPermission{CommandName: "mycmd", SubcommandNameChain: []string{"*", "..."}}
+
+		//a single wildcard does not include a trailing wildcard
+		assert.False(t, permAnySub.Includes(permAnyChain))
+		assert.False(t, permSub1a.Includes(permAnyChain))
+		assert.False(t, permAnySub.Includes(permAThenAnyChain))
+
+		//a single wildcard is only included by a single or a trailing wildcard
+		assert.True(t, permAnySub.Includes(permAnySub))
+		assert.True(t, permAnyChain.Includes(permAnySub))
+		assert.False(t, permSub1a.Includes(permAnySub))
+
+		//a trailing wildcard is only included by a trailing wildcard at the same or at an earlier position
+		assert.True(t, permAnyChain.Includes(permAnyChain))
+		assert.True(t, permAnyChain.Includes(permAThenAnyChain))
+		assert.True(t, permAThenAnyChain.Includes(permAThenAnyChain))
+		assert.True(t, permAnySubThenAnyChain.Includes(permAThenAnyChain))
+		assert.False(t, permAThenAnyChain.Includes(permAnyChain))
+		assert.False(t, permAnySubThenAnyChain.Includes(permAnyChain))
+	})
+
+	t.Run("trailing wildcard followed by a subcommand in requirements", func(t *testing.T) {
+		n := MustParseModule(`{git: {"...": {push: {}}}}`)
+		_, err := getCommandPermissions(n.Statements[0])
+		assert.Error(t, err)
+	})
 }
 
 func TestFilesystemPermission(t *testing.T) {
@@ -7728,32 +10127,317 @@ func TestContextlessCallPermission(t *testing.T) {
 	assert.False(t, funCallPerm2.Includes(funCallPerm))
 }
 
-func TestForbiddenPermissions(t *testing.T) {
+func TestTopicPermission(t *testing.T) {
 
-	readGoFiles := FilesystemPermission{ReadPerm, PathPattern("./*.go")}
-	readFile := FilesystemPermission{ReadPerm, Path("./file.go")}
+	consumeAnyPerm := TopicPermission{ConsumePerm, "*"}
+	consumeNewsPerm := TopicPermission{ConsumePerm, "news"}
+	consumeWeatherPerm := TopicPermission{ConsumePerm, "weather"}
+	provideNewsPerm := TopicPermission{ProvidePerm, "news"}
 
-	ctx := NewContext([]Permission{readGoFiles}, []Permission{readFile}, nil)
+	assert.True(t, consumeAnyPerm.Includes(consumeNewsPerm))
+	assert.True(t, consumeNewsPerm.Includes(consumeNewsPerm))
 
-	assert.True(t, ctx.HasPermission(readGoFiles))
-	assert.False(t, ctx.HasPermission(readFile))
+	assert.False(t, consumeNewsPerm.Includes(consumeAnyPerm))
+	assert.False(t, consumeNewsPerm.Includes(consumeWeatherPerm))
+	assert.False(t, consumeNewsPerm.Includes(provideNewsPerm))
+	assert.False(t, provideNewsPerm.Includes(consumeNewsPerm))
 }
 
-func TestDropPermissions(t *testing.T) {
-	readGoFiles := FilesystemPermission{ReadPerm, PathPattern("./*.go")}
-	readFile := FilesystemPermission{ReadPerm, Path("./file.go")}
+func TestMessageTopics(t *testing.T) {
 
-	ctx := NewContext([]Permission{readGoFiles}, []Permission{readFile}, nil)
+	newState := func(perms ...Permission) *State {
+		return NewState(NewContext(append(perms, RoutinePermission{CreatePerm}), nil, nil))
+	}
 
-	ctx.DropPermissions([]Permission{readGoFiles})
+	spawnConsumer := func(t *testing.T, topics *MessageTopics, routinePerms ...Permission) (interface{}, error) {
+		state := newState()
+		mod := MustParseModule(`
+			return $$topics.Consume("news")!
+		`)
+		globals := map[string]interface{}{
+			"topics": topics,
+		}
 
-	assert.False(t, ctx.HasPermission(readGoFiles))
-	assert.False(t, ctx.HasPermission(readFile))
-}
+		routineCtx := NewContext(append(routinePerms, GlobalVarPermission{ReadPerm, "*"}), nil, nil)
+		routine, err := spawnRoutine(state, globals, mod, routineCtx)
+		assert.NoError(t, err)
 
-func TestStackPermission(t *testing.T) {
-	perm1 := StackPermission{maxHeight: 1}
-	assert.True(t, perm1.Includes(perm1))
+		return routine.WaitResult(nil)
+	}
+
+	t.Run("publish without the provide permission", func(t *testing.T) {
+		topics := NewMessageTopics()
+		ctx := NewContext([]Permission{TopicPermission{ConsumePerm, "news"}}, nil, nil)
+
+		assert.Error(t, topics.Publish(ctx, "news", 1))
+	})
+
+	t.Run("routine without the consume permission", func(t *testing.T) {
+		topics := NewMessageTopics()
+		ctx := NewContext([]Permission{TopicPermission{ProvidePerm, "news"}}, nil, nil)
+		assert.NoError(t, topics.Publish(ctx, "news", 1))
+
+		_, err := spawnConsumer(t, topics, TopicPermission{ConsumePerm, "weather"})
+		assert.Error(t, err)
+	})
+
+	t.Run("routine with the consume permission", func(t *testing.T) {
+		topics := NewMessageTopics()
+		ctx := NewContext([]Permission{TopicPermission{ProvidePerm, "news"}}, nil, nil)
+		assert.NoError(t, topics.Publish(ctx, "news", 1))
+		assert.NoError(t, topics.Publish(ctx, "news", 2))
+
+		res, err := spawnConsumer(t, topics, TopicPermission{ConsumePerm, "news"})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, res)
+
+		res, err = spawnConsumer(t, topics, TopicPermission{ConsumePerm, "*"})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, res)
+
+		consumeCtx := NewContext([]Permission{TopicPermission{ConsumePerm, "news"}}, nil, nil)
+		res, err = topics.Consume(consumeCtx, "news")
+		assert.NoError(t, err)
+		assert.Nil(t, res)
+	})
+	t.Run("consumed messages are not retained", func(t *testing.T) {
+		topics := NewMessageTopics()
+		ctx := NewContext([]Permission{
+			TopicPermission{ProvidePerm, "news"},
+			TopicPermission{ConsumePerm, "news"},
+		}, nil, nil)
+
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, topics.Publish(ctx, "news", i))
+		}
+
+		res, err := topics.Consume(ctx, "news")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, res)
+
+		queue := topics.queues["news"]
+		assert.Equal(t, []interface{}{1, 2}, queue)
+		for _, message := range queue[len(queue):cap(queue)] {
+			assert.Nil(t, message)
+		}
+
+		topics.Consume(ctx, "news")
+		topics.Consume(ctx, "news")
+		assert.NotContains(t, topics.queues, "news")
+	})
+}
+
+func TestForbiddenPermissions(t *testing.T) {
+
+	readGoFiles := FilesystemPermission{ReadPerm, PathPattern("./*.go")}
+	readFile := FilesystemPermission{ReadPerm, Path("./file.go")}
+
+	ctx := NewContext([]Permission{readGoFiles}, []Permission{readFile}, nil)
+
+	assert.True(t, ctx.HasPermission(readGoFiles))
+	assert.False(t, ctx.HasPermission(readFile))
+}
+
+func TestDropPermissions(t *testing.T) {
+	readGoFiles := FilesystemPermission{ReadPerm, PathPattern("./*.go")}
+	readFile := FilesystemPermission{ReadPerm, Path("./file.go")}
+
+	ctx := NewContext([]Permission{readGoFiles}, []Permission{readFile}, nil)
+
+	ctx.DropPermissions([]Permission{readGoFiles})
+
+	assert.False(t, ctx.HasPermission(readGoFiles))
+	assert.False(t, ctx.HasPermission(readFile))
+}
+
+func TestForbid(t *testing.T) {
+	readExampleCom := HttpPermission{ReadPerm, HTTPHost("https://example.com")}
+	readExampleOrg := HttpPermission{ReadPerm, HTTPHost("https://example.org")}
+
+	ctx := NewContext([]Permission{HttpPermission{ReadPerm, HTTPHostPattern("https://*")}}, nil, nil)
+	ctx.Forbid(readExampleCom)
+
+	assert.False(t, ctx.HasPermission(readExampleCom))
+	assert.True(t, ctx.HasPermission(readExampleOrg))
+	assert.Error(t, ctx.CheckHasPermission(readExampleCom))
+}
+
+func TestWouldDrop(t *testing.T) {
+	readGoFiles := FilesystemPermission{ReadPerm, PathPattern("./*.go")}
+	readFile := FilesystemPermission{ReadPerm, Path("./file.go")}
+	readOtherFile := FilesystemPermission{ReadPerm, Path("./file.txt")}
+	readGlobals := GlobalVarPermission{ReadPerm, "*"}
+
+	ctx := NewContext([]Permission{readFile, readOtherFile, readGlobals}, nil, nil)
+	droppedPerms := []Permission{readGoFiles}
+
+	wouldDrop := ctx.WouldDrop(droppedPerms)
+	assert.Equal(t, []Permission{readFile}, wouldDrop)
+
+	//the context should not be modified
+	assert.True(t, ctx.HasPermission(readFile))
+
+	before := ctx.grantedPermissions
+	ctx.DropPermissions(droppedPerms)
+
+	var actuallyDropped []Permission
+	for _, perm := range before {
+		if !ctx.HasPermission(perm) {
+			actuallyDropped = append(actuallyDropped, perm)
+		}
+	}
+	assert.Equal(t, wouldDrop, actuallyDropped)
+}
+
+func TestWithPatterns(t *testing.T) {
+
+	t.Run("registered patterns should be usable by the script", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		err := ctx.WithPatterns(map[string]Matcher{
+			"email": RegexMatcher{regexp.MustCompile(`^[a-z]+@[a-z]+\.[a-z]+$`)},
+			"one":   ExactSimpleValueMatcher{1},
+		})
+		assert.NoError(t, err)
+
+		mod := MustParseModule(`return [("foo@example.com" match %email), ("foo" match %email), (1 match %one)]`)
+
+		res, err := Eval(mod, NewState(ctx))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false, true}, res)
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.WithPatterns(map[string]Matcher{"one": ExactSimpleValueMatcher{1}}))
+
+		err := ctx.WithPatterns(map[string]Matcher{
+			"one": ExactSimpleValueMatcher{2},
+			"two": ExactSimpleValueMatcher{2},
+		})
+		assert.Error(t, err)
+
+		//no pattern should have been registered
+		assert.Equal(t, ExactSimpleValueMatcher{1}, ctx.resolveNamedPattern("one"))
+		assert.Nil(t, ctx.resolveNamedPattern("two"))
+	})
+}
+
+func TestMatcherCombinators(t *testing.T) {
+	lowercase := RegexMatcher{regexp.MustCompile(`^[a-z]+$`)}
+	hasLowercaseName := &ObjectPattern{EntryMatchers: map[string]Matcher{"name": lowercase}}
+	isAdmin := &ObjectPattern{EntryMatchers: map[string]Matcher{"admin": ExactSimpleValueMatcher{true}}}
+
+	t.Run("and", func(t *testing.T) {
+		matcher := NewAndMatcher(hasLowercaseName, NewNotMatcher(isAdmin))
+
+		assert.True(t, matcher.Test(Object{"name": "foo", "admin": false}))
+		assert.False(t, matcher.Test(Object{"name": "foo", "admin": true}))
+		assert.False(t, matcher.Test(Object{"name": "Foo", "admin": false}))
+		assert.True(t, NewAndMatcher().Test(1))
+	})
+
+	t.Run("or", func(t *testing.T) {
+		matcher := NewOrMatcher(hasLowercaseName, lowercase)
+
+		assert.True(t, matcher.Test(Object{"name": "foo"}))
+		assert.True(t, matcher.Test("foo"))
+		assert.False(t, matcher.Test("Foo"))
+		assert.False(t, matcher.Test(Object{"name": "Foo"}))
+		assert.False(t, NewOrMatcher().Test(1))
+	})
+
+	t.Run("not", func(t *testing.T) {
+		matcher := NewNotMatcher(lowercase)
+
+		assert.True(t, matcher.Test("Foo"))
+		assert.True(t, matcher.Test(1))
+		assert.False(t, matcher.Test("foo"))
+	})
+
+	t.Run("registered combination", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.WithPatterns(map[string]Matcher{
+			"user": NewAndMatcher(hasLowercaseName, NewNotMatcher(isAdmin)),
+		}))
+
+		mod := MustParseModule(`return [({name: "foo"} match %user), ({name: "foo", admin: true} match %user)]`)
+		res, err := Eval(mod, NewState(ctx))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, false}, res)
+	})
+}
+
+func TestPermissionAuditor(t *testing.T) {
+
+	type permissionCheck struct {
+		perm    Permission
+		allowed bool
+	}
+
+	var lock sync.Mutex
+	var checks []permissionCheck
+
+	ctx := NewContext([]Permission{
+		GlobalVarPermission{ReadPerm, "*"},
+		GlobalVarPermission{UsePerm, "*"},
+		RoutinePermission{CreatePerm},
+	}, nil, nil)
+
+	ctx.SetPermissionAuditor(func(perm Permission, allowed bool) {
+		lock.Lock()
+		defer lock.Unlock()
+		checks = append(checks, permissionCheck{perm, allowed})
+	})
+
+	mod := MustParseModule(`
+		$rt = sr nil { return 1 }
+		$rt.WaitResult()!
+		return $$a
+	`)
+
+	res, err := Eval(mod, NewState(ctx, map[string]interface{}{"a": 1}))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res)
+
+	assert.Equal(t, []permissionCheck{
+		{RoutinePermission{CreatePerm}, true},
+		{GlobalVarPermission{ReadPerm, "a"}, true},
+	}, checks)
+
+	//denied checks are also recorded
+	checks = nil
+	assert.False(t, ctx.HasPermission(GlobalVarPermission{UpdatePerm, "a"}))
+	assert.Error(t, ctx.CheckHasPermission(GlobalVarPermission{CreatePerm, "b"}))
+	assert.Equal(t, []permissionCheck{
+		{GlobalVarPermission{UpdatePerm, "a"}, false},
+		{GlobalVarPermission{CreatePerm, "b"}, false},
+	}, checks)
+
+	//a single check is recorded for the host of an alias
+	checks = nil
+	aliasCtx, _ := ctx.NewWith([]Permission{HttpPermission{CreatePerm, HTTPHost("https://example.com")}})
+	aliasCtx.addHostAlias("api", HTTPHost("https://example.com"))
+	aliasCtx.addHostAlias("other", HTTPHost("https://example.org"))
+
+	_, err = Eval(MustParseModule(`@api/index.html`).Statements[0], NewState(aliasCtx))
+	assert.NoError(t, err)
+	_, err = Eval(MustParseModule(`@other/index.html`).Statements[0], NewState(aliasCtx))
+	assert.Error(t, err)
+	assert.Equal(t, []permissionCheck{
+		{HttpPermission{CreatePerm, HTTPHost("https://example.com")}, true},
+		{HttpPermission{ReadPerm, HTTPHost("https://example.org")}, false},
+	}, checks)
+
+	//no checks are recorded after the auditor is removed
+	checks = nil
+	ctx.SetPermissionAuditor(nil)
+	ctx.HasPermission(GlobalVarPermission{ReadPerm, "a"})
+	assert.Empty(t, checks)
+}
+
+func TestStackPermission(t *testing.T) {
+	perm1 := StackPermission{maxHeight: 1}
+	assert.True(t, perm1.Includes(perm1))
 
 	perm2 := StackPermission{maxHeight: 2}
 	assert.True(t, perm2.Includes(perm2))
@@ -7761,6 +10445,122 @@ func TestStackPermission(t *testing.T) {
 	assert.False(t, perm1.Includes(perm2))
 }
 
+func TestMaxStackHeight(t *testing.T) {
+	code := `
+		fn fact(n){
+			if ($n < 2) {
+				return 1
+			}
+			return ($n * fact(($n - 1)))
+		}
+		return fact($$n)
+	`
+
+	t.Run("default limit", func(t *testing.T) {
+		n := MustParseModule(code)
+		_, err := Eval(n, NewState(NewDefaultTestContext(), map[string]interface{}{"n": 10}))
+		assert.ErrorAs(t, err, &StackOverflowError{})
+	})
+
+	t.Run("raised limit", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.SetMaxStackHeight(20))
+
+		n := MustParseModule(code)
+		res, err := Eval(n, NewState(ctx, map[string]interface{}{"n": 10}))
+		assert.NoError(t, err)
+		assert.Equal(t, 3628800, res)
+	})
+
+	t.Run("raised limit is inherited by the derived contexts", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.SetMaxStackHeight(20))
+
+		withCtx, _ := ctx.NewWith(nil)
+		withoutCtx, _ := ctx.NewWithout(nil)
+
+		for _, derived := range []*Context{withCtx, withoutCtx, ctx.ForkLimiters()} {
+			n := MustParseModule(code)
+			res, err := Eval(n, NewState(derived, map[string]interface{}{"n": 10}))
+			assert.NoError(t, err)
+			assert.Equal(t, 3628800, res)
+		}
+	})
+
+	t.Run("removing the stack permission lowers the limit", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{UsePerm, "*"},
+			GlobalVarPermission{CreatePerm, "*"},
+			StackPermission{maxHeight: TRULY_MAX_STACK_HEIGHT},
+		}, nil, nil)
+
+		n := MustParseModule(code)
+		res, err := Eval(n, NewState(ctx, map[string]interface{}{"n": 8}))
+		assert.NoError(t, err)
+		assert.Equal(t, 40320, res)
+
+		withoutCtx, _ := ctx.NewWithout([]Permission{StackPermission{maxHeight: TRULY_MAX_STACK_HEIGHT}})
+		assert.Equal(t, StackPermission{maxHeight: DEFAULT_MAX_STACK_HEIGHT}, withoutCtx.stackPermission)
+
+		_, err = Eval(n, NewState(withoutCtx, map[string]interface{}{"n": 8}))
+		assert.ErrorAs(t, err, &StackOverflowError{})
+	})
+
+	t.Run("recursion deeper than the raised limit", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.NoError(t, ctx.SetMaxStackHeight(STACK_HEIGHT_CEILING))
+
+		n := MustParseModule(code)
+		_, err := Eval(n, NewState(ctx, map[string]interface{}{"n": STACK_HEIGHT_CEILING + 1}))
+
+		var overflowErr StackOverflowError
+		if assert.ErrorAs(t, err, &overflowErr) {
+			assert.Equal(t, STACK_HEIGHT_CEILING, overflowErr.MaxHeight)
+		}
+	})
+
+	t.Run("limit past the ceiling", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.Error(t, ctx.SetMaxStackHeight(STACK_HEIGHT_CEILING+1))
+		assert.Error(t, ctx.SetMaxStackHeight(0))
+	})
+}
+
+type capturingLogger struct {
+	lock sync.Mutex
+	msgs []string
+}
+
+func (logger *capturingLogger) Printf(format string, v ...interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.msgs = append(logger.msgs, fmt.Sprintf(format, v...))
+}
+
+func (logger *capturingLogger) messages() []string {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	return logger.msgs
+}
+
+func TestAllowedHTTPEntities(t *testing.T) {
+	ctx := NewContext([]Permission{
+		HttpPermission{ReadPerm, HTTPHostPattern("https://*.example.com")},
+		GlobalVarPermission{ReadPerm, "*"},
+		HttpPermission{CreatePerm, URL("https://example.com/users")},
+		FilesystemPermission{ReadPerm, PathPattern("/...")},
+		HttpPermission{ReadPerm, URL("https://example.org/index.html")},
+	}, nil, nil)
+
+	assert.Equal(t, []interface{}{
+		HTTPHostPattern("https://*.example.com"),
+		URL("https://example.org/index.html"),
+	}, ctx.AllowedHTTPEntities(ReadPerm))
+	assert.Equal(t, []interface{}{URL("https://example.com/users")}, ctx.AllowedHTTPEntities(CreatePerm))
+	assert.Empty(t, ctx.AllowedHTTPEntities(DeletePerm))
+}
+
 func TestSpawnRoutine(t *testing.T) {
 
 	t.Run("spawning a routine without the required permission should fail", func(t *testing.T) {
@@ -7773,6 +10573,47 @@ func TestSpawnRoutine(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	t.Run("spawn & done hooks", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil)
+
+		var spawned *Routine
+		var done *Routine
+		var doneResult interface{}
+		var doneErr error
+
+		ctx.OnSpawn(func(routine *Routine) {
+			spawned = routine
+		})
+		ctx.OnRoutineDone(func(routine *Routine, result interface{}, err error) {
+			done = routine
+			doneResult = result
+			doneErr = err
+		})
+
+		state := NewState(ctx)
+		routine, err := spawnRoutine(state, map[string]interface{}{}, MustParseModule(`return 1`), nil)
+		assert.NoError(t, err)
+		assert.Same(t, routine, spawned)
+
+		_, err = routine.WaitResult(nil)
+		assert.NoError(t, err)
+		assert.Same(t, routine, done)
+		assert.Equal(t, 1, doneResult)
+		assert.NoError(t, doneErr)
+
+		//failing routine
+		routine, err = spawnRoutine(state, map[string]interface{}{}, MustParseModule(`return $$x`), nil)
+		assert.NoError(t, err)
+
+		_, err = routine.WaitResult(nil)
+		assert.Error(t, err)
+		assert.Same(t, routine, done)
+		assert.Nil(t, doneResult)
+		assert.Equal(t, err, doneErr)
+	})
+
 	t.Run("a routine should have access to globals passed to it", func(t *testing.T) {
 		state := NewState(NewContext([]Permission{
 			RoutinePermission{CreatePerm},
@@ -7811,67 +10652,339 @@ func TestSpawnRoutine(t *testing.T) {
 			value: Object{"a": 1},
 		}, res)
 	})
-}
-
-func TestTraverse(t *testing.T) {
 
-	t.Run("integer", func(t *testing.T) {
-		called := false
+	t.Run("the copied result of a routine should be a native value", func(t *testing.T) {
+		state := NewState(NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil))
+		mod := MustParseModule(`
+			return {a: {b: 1}, c: [1, "a"]}
+		`)
+		globals := map[string]interface{}{}
 
-		err := Traverse(1, func(v interface{}) (TraversalAction, error) {
-			called = true
-			return Continue, nil
-		}, TraversalConfiguration{})
+		routine, err := spawnRoutine(state, globals, mod, nil)
+		assert.NoError(t, err)
 
+		res, err := routine.WaitResultCopied(nil)
 		assert.NoError(t, err)
-		assert.True(t, called)
+		assert.Equal(t, Object{"a": Object{"b": 1}, "c": List{1, "a"}}, res)
 	})
 
-	t.Run("empty object", func(t *testing.T) {
-		called := false
-
-		err := Traverse(Object{}, func(v interface{}) (TraversalAction, error) {
-			called = true
-			return Continue, nil
-		}, TraversalConfiguration{})
+	t.Run("the copied result of a routine should be usable in the caller's module", func(t *testing.T) {
+		n := MustParseModule(`
+			$rt = sr nil {
+				return {a: 1, b: [1]}
+			}
+			$res = $rt.WaitResultCopied()!
+			$res.a = 2
+			return $res
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, Object{"a": 2, "b": List{1}}, res)
+	})
 
+	t.Run("globals passed with a key list", func(t *testing.T) {
+		n := MustParseModule(`
+			$$a = 1
+			$rt = sr .{a} {
+				return $$a
+			}
+			return $rt.WaitResult()!
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
 		assert.NoError(t, err)
-		assert.True(t, called)
+		assert.Equal(t, 1, res)
 	})
 
-	t.Run("object with an integer property : max depth = 0", func(t *testing.T) {
-		callCount := 0
+	t.Run("a key list of globals referencing a missing global should cause an error", func(t *testing.T) {
+		n := MustParseModule(`
+			$$a = 1
+			sr .{a, b} {
+				return $$a
+			}
+		`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.ErrorIs(t, err, UndefinedVariableError{Name: "b", Global: true})
+	})
 
-		err := Traverse(Object{"n": 1}, func(v interface{}) (TraversalAction, error) {
-			callCount++
-			return Continue, nil
-		}, TraversalConfiguration{MaxDepth: 0})
+	t.Run("a routine should not be able to reassign a constant of the spawning module", func(t *testing.T) {
+		state := NewState(NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil))
 
+		_, err := Eval(MustParseModule(`const ( a = 1 )`), state)
 		assert.NoError(t, err)
-		assert.Equal(t, 1, callCount)
-	})
 
-	t.Run("object with an integer property : max depth = 1", func(t *testing.T) {
-		callCount := 0
+		routineCtx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{UpdatePerm, "*"},
+		}, nil, nil)
 
-		err := Traverse(Object{"n": 1}, func(v interface{}) (TraversalAction, error) {
-			callCount++
-			return Continue, nil
-		}, TraversalConfiguration{MaxDepth: 1})
+		mod := MustParseModule(`
+			$$b = 2
+			$$a = 2
+		`)
+		globals := map[string]interface{}{
+			"a": 1,
+			"b": 1,
+		}
 
+		routine, err := spawnRoutine(state, globals, mod, routineCtx)
 		assert.NoError(t, err)
-		assert.Equal(t, 2, callCount)
+
+		_, err = routine.WaitResult(nil)
+		assert.Error(t, err)
+		assert.Equal(t, 2, routine.state.GlobalScope()["b"])
+		assert.Equal(t, 1, routine.state.GlobalScope()["a"])
 	})
 
-	t.Run("object with a reference to itself", func(t *testing.T) {
-		callCount := 0
+	t.Run("the failure of a routine should be logged with the logger of the spawning context", func(t *testing.T) {
+		stdLogOutput := &strings.Builder{}
+		prevOutput := log.Writer()
+		log.SetOutput(stdLogOutput)
+		defer log.SetOutput(prevOutput)
 
-		obj := Object{}
-		obj["self"] = obj
+		logger := &capturingLogger{}
+		ctx := NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil)
+		ctx.SetLogger(logger)
 
-		err := Traverse(obj, func(v interface{}) (TraversalAction, error) {
-			callCount++
-			return Continue, nil
+		state := NewState(ctx)
+		mod := MustParseModule(`
+			return $$x
+		`)
+
+		routine, err := spawnRoutine(state, map[string]interface{}{}, mod, nil)
+		assert.NoError(t, err)
+
+		_, err = routine.WaitResult(nil)
+		assert.Error(t, err)
+
+		if assert.Len(t, logger.messages(), 1) {
+			assert.Contains(t, logger.messages()[0], "a routine failed")
+		}
+		assert.Empty(t, stdLogOutput.String())
+	})
+
+	t.Run("waiting with a timeout for a fast routine should return its result", func(t *testing.T) {
+		state := NewState(NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil))
+		mod := MustParseModule(`
+			return 1
+		`)
+
+		routine, err := spawnRoutine(state, map[string]interface{}{}, mod, nil)
+		assert.NoError(t, err)
+
+		res, err := routine.WaitResultTimeout(nil, time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, res)
+	})
+
+	t.Run("waiting with a timeout for a slow routine should fail", func(t *testing.T) {
+		state := NewState(NewContext([]Permission{
+			RoutinePermission{CreatePerm},
+		}, nil, nil))
+		mod := MustParseModule(`
+			sleep()
+			return 1
+		`)
+		globals := map[string]interface{}{
+			"sleep": func(ctx *Context) {
+				time.Sleep(100 * time.Millisecond)
+			},
+		}
+
+		routine, err := spawnRoutine(state, globals, mod, nil)
+		assert.NoError(t, err)
+
+		res, err := routine.WaitResultTimeout(nil, 10*time.Millisecond)
+		assert.Nil(t, res)
+		assert.Equal(t, RoutineTimeoutError{Timeout: 10 * time.Millisecond}, err)
+
+		//the result is still available once the routine finishes
+		res, err = routine.WaitResult(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, res)
+	})
+}
+
+func TestStateLocalsGlobals(t *testing.T) {
+	var state *State
+	var locals, globals map[string]interface{}
+
+	mod := MustParseModule(`
+		$$a = 1
+		fn f(x){
+			$b = 2
+			snapshot()
+		}
+		f(3)
+	`)
+
+	state = NewState(NewDefaultTestContext(), map[string]interface{}{
+		"snapshot": func(ctx *Context) {
+			locals = state.Locals()
+			globals = state.Globals()
+		},
+		"user": User{Name: "Foo"},
+	})
+
+	_, err := Eval(mod, state)
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]interface{}{"x": 3, "b": 2}, locals)
+
+	assert.Equal(t, 1, globals["a"])
+	assert.Equal(t, User{Name: "Foo"}, globals["user"])
+	assert.IsType(t, func(ctx *Context) {}, globals["snapshot"])
+	assert.Contains(t, globals, "f")
+
+	//returned maps are copies
+	locals["c"] = 4
+	globals["c"] = 4
+	assert.NotContains(t, state.GlobalScope(), "c")
+}
+
+func TestStateSnapshot(t *testing.T) {
+	state := NewState(NewDefaultTestContext(), map[string]interface{}{
+		"a": 1,
+	})
+
+	_, err := Eval(MustParseModule(`$$obj = {list: [1]}`), state)
+	assert.NoError(t, err)
+
+	var initialReturnValue interface{} = List{1}
+	state.ReturnValue = &initialReturnValue
+	stackHeight := len(state.ScopeStack)
+
+	snapshot := state.Snapshot()
+
+	//mutate the scopes & the return value
+	_, err = state.EvalNode(MustParseModule(`$$a = 2`).Statements[0])
+	assert.NoError(t, err)
+
+	obj := state.GlobalScope()["obj"].(Object)
+	obj["b"] = 2
+	obj["list"].(List)[0] = 5
+
+	state.PushScope()
+	state.CurrentScope()["x"] = 1
+	var returnValue interface{} = 3
+	state.ReturnValue = &returnValue
+
+	for i := 0; i < 2; i++ {
+		state.Restore(snapshot)
+
+		assert.Len(t, state.ScopeStack, stackHeight)
+		assert.NotContains(t, state.CurrentScope(), "x")
+		assert.Equal(t, 1, state.GlobalScope()["a"])
+		assert.Equal(t, Object{"list": List{1}}, state.GlobalScope()["obj"])
+		assert.Equal(t, List{1}, *state.ReturnValue)
+
+		state.GlobalScope()["a"] = 3
+		(*state.ReturnValue).(List)[0] = 2
+	}
+}
+
+func TestStateEvalNode(t *testing.T) {
+	var state *State
+	var watched []interface{}
+
+	mod := MustParseModule(`
+		fn f(x){
+			$y = 2
+			watch()
+			return $y
+		}
+		return f(3)
+	`)
+	watchExpr := MustParseModule(`return ($x + $y)`).Statements[0].(*ReturnStatement).Expr
+	returnStmt := MustParseModule(`return 0`).Statements[0]
+
+	state = NewState(NewDefaultTestContext(), map[string]interface{}{
+		"watch": func(ctx *Context) {
+			res, err := state.EvalNode(watchExpr)
+			assert.NoError(t, err)
+			watched = append(watched, res)
+
+			//the return value should not be kept
+			_, err = state.EvalNode(returnStmt)
+			assert.NoError(t, err)
+		},
+	})
+
+	res, err := Eval(mod, state)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res)
+	assert.Equal(t, []interface{}{5}, watched)
+
+	_, err = state.EvalNode(mod)
+	assert.Error(t, err)
+}
+
+func TestTraverse(t *testing.T) {
+
+	t.Run("integer", func(t *testing.T) {
+		called := false
+
+		err := Traverse(1, func(v interface{}) (TraversalAction, error) {
+			called = true
+			return Continue, nil
+		}, TraversalConfiguration{})
+
+		assert.NoError(t, err)
+		assert.True(t, called)
+	})
+
+	t.Run("empty object", func(t *testing.T) {
+		called := false
+
+		err := Traverse(Object{}, func(v interface{}) (TraversalAction, error) {
+			called = true
+			return Continue, nil
+		}, TraversalConfiguration{})
+
+		assert.NoError(t, err)
+		assert.True(t, called)
+	})
+
+	t.Run("object with an integer property : max depth = 0", func(t *testing.T) {
+		callCount := 0
+
+		err := Traverse(Object{"n": 1}, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 0})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 1, callCount)
+	})
+
+	t.Run("object with an integer property : max depth = 1", func(t *testing.T) {
+		callCount := 0
+
+		err := Traverse(Object{"n": 1}, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 1})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, callCount)
+	})
+
+	t.Run("object with a reference to itself", func(t *testing.T) {
+		callCount := 0
+
+		obj := Object{}
+		obj["self"] = obj
+
+		err := Traverse(obj, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			return Continue, nil
 		}, TraversalConfiguration{MaxDepth: 10})
 
 		assert.NoError(t, err)
@@ -7941,6 +11054,214 @@ func TestTraverse(t *testing.T) {
 	})
 }
 
+func TestTraverseKeys(t *testing.T) {
+	v := Object{
+		"a": 1,
+		"b": Object{
+			"c": List{2},
+		},
+	}
+
+	t.Run("keys are visited", func(t *testing.T) {
+		var keys []string
+		callCount := 0
+
+		err := Traverse(v, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			if entry, ok := v.(ObjectEntry); ok {
+				keys = append(keys, entry.Key)
+			}
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 10, VisitKeys: true})
+
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, keys)
+		//3 objects & lists + 2 integers + 3 entries
+		assert.Equal(t, 8, callCount)
+	})
+
+	t.Run("keys are not visited", func(t *testing.T) {
+		callCount := 0
+
+		err := Traverse(v, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			assert.NotEqual(t, reflect.TypeOf(ObjectEntry{}), reflect.TypeOf(v))
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 10})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 5, callCount)
+	})
+
+	t.Run("pruning an entry", func(t *testing.T) {
+		var visited []interface{}
+
+		err := Traverse(v, func(v interface{}) (TraversalAction, error) {
+			visited = append(visited, v)
+			if entry, ok := v.(ObjectEntry); ok && entry.Key == "b" {
+				return Prune, nil
+			}
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 10, VisitKeys: true})
+
+		assert.NoError(t, err)
+		assert.Len(t, visited, 4)
+	})
+
+	t.Run("reserved keys are not visited", func(t *testing.T) {
+		obj := Object{}
+		obj.Set("b", 1)
+		obj.Set("a", 2)
+		obj[IMPLICIT_KEY_LEN_KEY] = 0
+
+		var keys []string
+		callCount := 0
+
+		err := Traverse(obj, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			if entry, ok := v.(ObjectEntry); ok {
+				keys = append(keys, entry.Key)
+			}
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 10, VisitKeys: true})
+
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a", "b"}, keys)
+		//1 object + 2 integers + 2 entries
+		assert.Equal(t, 5, callCount)
+	})
+
+	t.Run("object with a reference to itself", func(t *testing.T) {
+		obj := Object{}
+		obj["self"] = obj
+		callCount := 0
+
+		err := Traverse(obj, func(v interface{}) (TraversalAction, error) {
+			callCount++
+			return Continue, nil
+		}, TraversalConfiguration{MaxDepth: 10, VisitKeys: true})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, callCount)
+	})
+}
+
+func TestDiff(t *testing.T) {
+
+	t.Run("equal values", func(t *testing.T) {
+		assert.Equal(t, "", Diff(1, 1))
+		assert.Equal(t, "", Diff(Object{"a": List{1}}, Object{"a": List{1}}))
+	})
+
+	t.Run("simple values", func(t *testing.T) {
+		assert.Equal(t, ".: 1 != 2\n", Diff(1, 2))
+		assert.Equal(t, ".: 1 != \"1\"\n", Diff(1, "1"))
+	})
+
+	t.Run("objects differing in a nested key", func(t *testing.T) {
+		a := Object{"a": Object{"b": 1, "c": 2}, "d": 3}
+		b := Object{"a": Object{"b": 2, "c": 2}, "d": 3}
+		assert.Equal(t, ".a.b: 1 != 2\n", Diff(a, b))
+	})
+
+	t.Run("objects with missing keys", func(t *testing.T) {
+		a := Object{"a": 1}
+		b := Object{"b": 1}
+		assert.Equal(t, ".a: 1 != <missing>\n.b: <missing> != 1\n", Diff(a, b))
+	})
+
+	t.Run("lists differing in length", func(t *testing.T) {
+		assert.Equal(t, "[2]: <missing> != 3\n", Diff(List{1, 2}, List{1, 2, 3}))
+		assert.Equal(t, "[1]: 2 != <missing>\n", Diff(List{1, 2}, List{1}))
+	})
+
+	t.Run("list in an object", func(t *testing.T) {
+		a := Object{"a": List{1, Object{"b": 1}}}
+		b := Object{"a": List{1, Object{"b": 2}}}
+		assert.Equal(t, ".a[1].b: 1 != 2\n", Diff(a, b))
+	})
+
+	t.Run("object and list", func(t *testing.T) {
+		assert.Equal(t, ".: gopherscript.Object{} != gopherscript.List{}\n", Diff(Object{}, List{}))
+	})
+}
+
+func TestModuleCache(t *testing.T) {
+
+	t.Run("the least recently used module should be evicted", func(t *testing.T) {
+		cache := NewModuleCache(2)
+		cache.Set("a", "return 1")
+		cache.Set("b", "return 2")
+
+		//a becomes the most recently used module
+		src, ok := cache.Get("a")
+		assert.True(t, ok)
+		assert.Equal(t, "return 1", src)
+
+		cache.Set("c", "return 3")
+		assert.Equal(t, 2, cache.Len())
+
+		_, ok = cache.Get("b")
+		assert.False(t, ok)
+
+		_, ok = cache.Get("a")
+		assert.True(t, ok)
+
+		_, ok = cache.Get("c")
+		assert.True(t, ok)
+	})
+
+	t.Run("updating a module should not evict another module", func(t *testing.T) {
+		cache := NewModuleCache(2)
+		cache.Set("a", "return 1")
+		cache.Set("b", "return 2")
+		cache.Set("a", "return 3")
+
+		assert.Equal(t, 2, cache.Len())
+		src, _ := cache.Get("a")
+		assert.Equal(t, "return 3", src)
+		_, ok := cache.Get("b")
+		assert.True(t, ok)
+	})
+
+	t.Run("the default cache contains the preseeded modules", func(t *testing.T) {
+		_, ok := defaultModuleCache.Get(RETURN_1_MODULE_HASH)
+		assert.True(t, ok)
+		_, ok = defaultModuleCache.Get(RETURN_GLOBAL_A_MODULE_HASH)
+		assert.True(t, ok)
+	})
+
+	t.Run("the preseeded modules should never be evicted", func(t *testing.T) {
+		cache := NewModuleCache(1)
+		src, ok := cache.Get(RETURN_1_MODULE_HASH)
+		assert.True(t, ok)
+		assert.Equal(t, "return 1", src)
+
+		cache.Set("a", "return 2")
+		cache.Set("b", "return 3")
+		cache.Set(RETURN_GLOBAL_A_MODULE_HASH, "return 4")
+		assert.Equal(t, 1, cache.Len())
+
+		src, ok = cache.Get(RETURN_1_MODULE_HASH)
+		assert.True(t, ok)
+		assert.Equal(t, "return 1", src)
+
+		src, ok = cache.Get(RETURN_GLOBAL_A_MODULE_HASH)
+		assert.True(t, ok)
+		assert.Equal(t, "return $$a", src)
+
+		_, ok = cache.Get("b")
+		assert.True(t, ok)
+	})
+}
+
+// rewindLimiter makes the next decrement of the limiter's bucket act as if d more time had elapsed.
+func rewindLimiter(limiter *Limiter, d time.Duration) {
+	limiter.bucket.tokenMutex.Lock()
+	defer limiter.bucket.tokenMutex.Unlock()
+	limiter.bucket.lastDecrementTime = limiter.bucket.lastDecrementTime.Add(-d)
+}
+
 func TestLimiters(t *testing.T) {
 
 	t.Run("byte rate", func(t *testing.T) {
@@ -7979,59 +11300,1233 @@ func TestLimiters(t *testing.T) {
 		assert.WithinDuration(t, expectedTime, time.Now(), 200*time.Millisecond)
 	})
 
-	t.Run("total", func(t *testing.T) {
-		ctx := NewContext(nil, nil, []Limitation{
-			{Name: "fs/total-read-file", Total: 1},
-		})
+	t.Run("total", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 1},
+		})
+
+		ctx.Take("fs/total-read-file", 1)
+
+		assert.Panics(t, func() {
+			ctx.Take("fs/total-read-file", 1)
+		})
+	})
+
+	t.Run("effective limit", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+		}, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+		})
+		ctx.Take("fs/total-read-file", 2)
+
+		capacity, available, shared := ctx.EffectiveLimit("fs/total-read-file")
+		assert.EqualValues(t, 10, capacity)
+		assert.EqualValues(t, 8, available)
+		assert.False(t, shared)
+
+		child, err := ctx.NewWithout([]Permission{GlobalVarPermission{ReadPerm, "*"}})
+		assert.NoError(t, err)
+		child.Take("fs/total-read-file", 1)
+
+		capacity, available, shared = child.EffectiveLimit("fs/total-read-file")
+		assert.EqualValues(t, 10, capacity)
+		assert.EqualValues(t, 7, available)
+		assert.True(t, shared)
+
+		_, _, shared = ctx.EffectiveLimit("fs/total-read-file")
+		assert.True(t, shared)
+
+		capacity, available, shared = ctx.EffectiveLimit("fs/read")
+		assert.Zero(t, capacity)
+		assert.Zero(t, available)
+		assert.False(t, shared)
+	})
+
+	t.Run("effective limit : limiters are no longer shared with finished routines", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{CreatePerm, "*"},
+			RoutinePermission{CreatePerm},
+		}, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+		})
+
+		state := NewState(ctx)
+		routine, err := spawnRoutine(state, map[string]interface{}{}, MustParseModule(""), nil)
+		assert.NoError(t, err)
+
+		_, err = routine.WaitResult(ctx)
+		assert.NoError(t, err)
+
+		_, _, shared := ctx.EffectiveLimit("fs/total-read-file")
+		assert.False(t, shared)
+	})
+
+	t.Run("effective limit : limiters are no longer shared with finished routines of modules with requirements", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{UsePerm, "*"},
+			GlobalVarPermission{CreatePerm, "*"},
+			HttpPermission{ReadPerm, URL("https://example.com/")},
+			RoutinePermission{CreatePerm},
+		}, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+		})
+
+		_, err := Eval(MustParseModule(`
+			$rt = sr nil { 
+				require {
+					read: https://example.com/
+				}
+			} allow { 
+				read: https://example.com/
+			}
+
+			$rt.WaitResult()!
+		`), NewState(ctx))
+		assert.NoError(t, err)
+
+		_, _, shared := ctx.EffectiveLimit("fs/total-read-file")
+		assert.False(t, shared)
+	})
+
+	t.Run("usage report", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{UsePerm, "*"},
+		}, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+			{Name: "fs/read", ByteRate: 1_000},
+		})
+
+		n := MustParseModule(`read(2); read(1)`)
+		state := NewState(ctx, map[string]interface{}{
+			"read": func(ctx *Context, count int) {
+				ctx.Take("fs/total-read-file", int64(count))
+			},
+		})
+
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		assert.Equal(t, map[string]int64{
+			"fs/total-read-file": 3,
+			"fs/read":            0,
+		}, ctx.UsageReport())
+
+		assert.Greater(t, ctx.TotalElapsed(), time.Duration(0))
+	})
+
+	t.Run("fork", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+		})
+		ctx.Take("fs/total-read-file", 2)
+
+		fork := ctx.ForkLimiters()
+		assert.EqualValues(t, 8, fork.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+
+		fork.Take("fs/total-read-file", 5)
+		assert.EqualValues(t, 3, fork.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+		assert.EqualValues(t, 8, ctx.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+
+		assert.Panics(t, func() {
+			fork.Take("fs/total-read-file", 4)
+		})
+		ctx.Take("fs/total-read-file", 4)
+	})
+
+	t.Run("clone", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+		}, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Hour)},
+		})
+		ctx.Take("fs/total-read-file", 2)
+		ctx.addHostAlias("api", HTTPHost("https://example.com"))
+		ctx.addNamedPattern("int", ExactSimpleValueMatcher{1})
+
+		clone := ctx.Clone()
+		assert.EqualValues(t, 8, clone.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+		assert.Equal(t, HTTPHost("https://example.com"), clone.resolveHostAlias("api"))
+		assert.Equal(t, ExactSimpleValueMatcher{1}, clone.resolveNamedPattern("int"))
+
+		//mutations of the clone should not affect the original context
+		clone.DropPermissions([]Permission{GlobalVarPermission{ReadPerm, "*"}})
+		clone.Take("fs/total-read-file", 5)
+		clone.limitations[0].Total = 100
+		clone.addHostAlias("other", HTTPHost("https://example.org"))
+
+		assert.False(t, clone.HasPermission(GlobalVarPermission{ReadPerm, "x"}))
+		assert.True(t, ctx.HasPermission(GlobalVarPermission{ReadPerm, "x"}))
+		assert.EqualValues(t, 3, clone.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+		assert.EqualValues(t, 8, ctx.limiters["fs/total-read-file"].bucket.Availible()/TOKEN_BUCKET_CAPACITY_SCALE)
+		assert.EqualValues(t, 10, ctx.limitations[0].Total)
+		assert.Nil(t, ctx.resolveHostAlias("other"))
+
+		//the compute time of the clone should depend on the load type of the clone
+		ctx.SetLoadType(IOLoad)
+		decrementFn := clone.limiters[COMPUTE_TIME_TOTAL_LIMIT_NAME].limitation.DecrementFn
+		assert.Greater(t, decrementFn(time.Now().Add(-time.Second)), int64(0))
+	})
+
+	t.Run("host-qualified limits", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "http/download@*.example.com", Total: 2},
+			{Name: "http/download@https://example.org", Total: 1},
+		})
+
+		//the two hosts have independent budgets
+		ctx.TakeForHost("http/download", "https://a.example.com", 2)
+		ctx.TakeForHost("http/download", "https://example.org", 1)
+
+		assert.Panics(t, func() {
+			ctx.TakeForHost("http/download", "https://b.example.com", 1)
+		})
+		assert.Panics(t, func() {
+			ctx.TakeForHost("http/download", "https://example.org", 1)
+		})
+
+		//hosts not matching any pattern are not limited
+		ctx.TakeForHost("http/download", "http://example.org", 1)
+		ctx.TakeForHost("http/download", "https://example.net", 1)
+		ctx.TakeForHost("http/upload", "https://a.example.com", 1)
+	})
+
+	t.Run("host-qualified limit with an invalid host pattern", func(t *testing.T) {
+		mod := MustParseModule(`
+			require {
+				limits: {
+					"http/download@a b": 100kB/s
+				}
+			}
+		`)
+		assert.Panics(t, func() {
+			mod.Requirements.Object.PermissionsLimitations(nil, nil, nil, nil)
+		})
+	})
+
+	t.Run("merge limitations", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 2},
+			{Name: "fs/read", ByteRate: 1_000},
+		})
+		ctx.Take("fs/total-read-file", 2)
+
+		//a total limit is topped up & a new limit is added
+		err := ctx.MergeLimitations([]Limitation{
+			{Name: "fs/total-read-file", Total: 3},
+			{Name: "fs/total-new-file", Total: 1},
+		})
+		assert.NoError(t, err)
+		assert.Len(t, ctx.limitations, 3)
+
+		ctx.Take("fs/total-read-file", 3)
+		assert.Panics(t, func() {
+			ctx.Take("fs/total-read-file", 1)
+		})
+
+		ctx.Take("fs/total-new-file", 1)
+		assert.Panics(t, func() {
+			ctx.Take("fs/total-new-file", 1)
+		})
+
+		//conflicting limitations
+		assert.Error(t, ctx.MergeLimitations([]Limitation{{Name: "fs/read", ByteRate: 2_000}}))
+		assert.Error(t, ctx.MergeLimitations([]Limitation{{Name: "fs/read", Total: 10}}))
+		assert.Error(t, ctx.MergeLimitations([]Limitation{{Name: "fs/total-read-file", SimpleRate: 10}}))
+		assert.Error(t, ctx.MergeLimitations([]Limitation{{Name: "a", Total: 1}, {Name: "a", Total: 1}}))
+
+		//an invalid merge should not modify the context
+		assert.Error(t, ctx.MergeLimitations([]Limitation{
+			{Name: "fs/total-read-file", Total: 10},
+			{Name: "fs/read", Total: 10},
+		}))
+		assert.Panics(t, func() {
+			ctx.Take("fs/total-read-file", 1)
+		})
+		assert.NoError(t, ctx.MergeLimitations([]Limitation{{Name: "fs/read", ByteRate: 1_000}}))
+	})
+
+	t.Run("merge limitations while a context sharing the limiters is used", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 1_000_000},
+		})
+		derived, _ := ctx.NewWithout(nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				derived.Take("fs/total-read-file", 1)
+				derived.EffectiveLimit("fs/total-read-file")
+			}
+		}()
+
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, ctx.MergeLimitations([]Limitation{
+				{Name: "fs/total-read-file", Total: 1},
+				{Name: "fs/total-new-file-" + strconv.Itoa(i), Total: 1},
+			}))
+		}
+		<-done
+
+		capacity, _, _ := derived.EffectiveLimit("fs/total-read-file")
+		assert.EqualValues(t, 1_000_100, capacity)
+
+		//new limiters are not added to the contexts that were already sharing the limiters
+		_, ok := derived.limiters["fs/total-new-file-0"]
+		assert.False(t, ok)
+		_, ok = ctx.limiters["fs/total-new-file-0"]
+		assert.True(t, ok)
+	})
+
+	t.Run("auto decrement", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{
+				Name:  "test",
+				Total: int64(time.Second),
+				DecrementFn: func(lastDecrementTime time.Time) int64 {
+					v := TOKEN_BUCKET_CAPACITY_SCALE * time.Since(lastDecrementTime)
+					return v.Nanoseconds()
+				},
+			},
+		})
+
+		capacity := int64(time.Second * TOKEN_BUCKET_CAPACITY_SCALE)
+
+		assert.Equal(t, capacity, ctx.limiters["test"].bucket.avail)
+		time.Sleep(time.Second)
+		assert.InDelta(t, int64(0), ctx.limiters["test"].bucket.avail, float64(capacity/20))
+	})
+
+	t.Run("compute and IO time", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{UsePerm, "*"},
+		}, nil, []Limitation{
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+			{Name: IO_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+		})
+
+		n := MustParseModule(`read()`)
+		state := NewState(ctx, map[string]interface{}{
+			"read": func(ctx *Context) {
+				ctx.SetLoadType(IOLoad)
+				defer ctx.SetLoadType(ComputeLoad)
+
+				//simulate 500ms of IO
+				rewindLimiter(ctx.limiters[IO_TIME_TOTAL_LIMIT_NAME], 500*time.Millisecond)
+				ctx.chargeLoadTime()
+			},
+		})
+
+		_, err := Eval(n, state)
+		assert.NoError(t, err)
+
+		_, computeAvailable, _ := ctx.EffectiveLimit(COMPUTE_TIME_TOTAL_LIMIT_NAME)
+		_, ioAvailable, _ := ctx.EffectiveLimit(IO_TIME_TOTAL_LIMIT_NAME)
+
+		assert.InDelta(t, int64(time.Second), computeAvailable, float64(50*time.Millisecond))
+		assert.InDelta(t, int64(500*time.Millisecond), ioAvailable, float64(50*time.Millisecond))
+	})
+
+	t.Run("fork : compute and IO time depend on the load type of the fork", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+			{Name: IO_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+		})
+		fork := ctx.ForkLimiters()
+		ctx.SetLoadType(IOLoad)
+
+		//the fork is still doing compute
+		rewindLimiter(fork.limiters[COMPUTE_TIME_TOTAL_LIMIT_NAME], 500*time.Millisecond)
+		rewindLimiter(fork.limiters[IO_TIME_TOTAL_LIMIT_NAME], 500*time.Millisecond)
+		fork.chargeLoadTime()
+
+		_, computeAvailable, _ := fork.EffectiveLimit(COMPUTE_TIME_TOTAL_LIMIT_NAME)
+		_, ioAvailable, _ := fork.EffectiveLimit(IO_TIME_TOTAL_LIMIT_NAME)
+
+		assert.InDelta(t, int64(500*time.Millisecond), computeAvailable, float64(50*time.Millisecond))
+		assert.InDelta(t, int64(time.Second), ioAvailable, float64(50*time.Millisecond))
+	})
+
+	t.Run("execution total : compute time is checked but not taken", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(2 * time.Second)},
+		})
+
+		assert.NoError(t, ctx.TryTake(EXECUTION_TOTAL_LIMIT_NAME, int64(time.Second)))
+
+		_, computeAvailable, _ := ctx.EffectiveLimit(COMPUTE_TIME_TOTAL_LIMIT_NAME)
+		assert.InDelta(t, int64(2*time.Second), computeAvailable, float64(50*time.Millisecond))
+	})
+
+	t.Run("Use", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+			{Name: IO_TIME_TOTAL_LIMIT_NAME, Total: int64(time.Second)},
+		})
+		ctx.SetLoadType(IOLoad)
+
+		res, err := ctx.Use(ComputeLoad, func() (interface{}, error) {
+			assert.Equal(t, ComputeLoad, ctx.loadType())
+			time.Sleep(300 * time.Millisecond)
+			return 1, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, res)
+		assert.Equal(t, IOLoad, ctx.loadType())
+
+		_, computeAvailable, _ := ctx.EffectiveLimit(COMPUTE_TIME_TOTAL_LIMIT_NAME)
+		assert.InDelta(t, int64(700*time.Millisecond), computeAvailable, float64(50*time.Millisecond))
+
+		//the error of the callback should be returned
+		_, err = ctx.Use(ComputeLoad, func() (interface{}, error) {
+			return nil, errors.New("callback error")
+		})
+		assert.EqualError(t, err, "callback error")
+		assert.Equal(t, IOLoad, ctx.loadType())
+	})
+
+	t.Run("compute time : total limit reached", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: COMPUTE_TIME_TOTAL_LIMIT_NAME, Total: int64(100 * time.Millisecond)},
+		})
+
+		rewindLimiter(ctx.limiters[COMPUTE_TIME_TOTAL_LIMIT_NAME], 200*time.Millisecond)
+		ctx.chargeLoadTime()
+
+		assert.Panics(t, func() {
+			ctx.Take(EXECUTION_TOTAL_LIMIT_NAME, 1)
+		})
+	})
+
+	t.Run("TryTake", func(t *testing.T) {
+		ctx := NewContext(nil, nil, []Limitation{
+			{Name: "fs/total-read-file", Total: 2},
+		})
+
+		assert.NoError(t, ctx.TryTake("fs/total-read-file", 2))
+		assert.Error(t, ctx.TryTake("fs/total-read-file", 1))
+
+		//no limit
+		assert.NoError(t, ctx.TryTake("fs/read", 1))
+	})
+
+	t.Run("execution total limit reached during evaluation", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+			GlobalVarPermission{CreatePerm, "*"},
+		}, nil, []Limitation{
+			{Name: EXECUTION_TOTAL_LIMIT_NAME, Total: 2},
+		})
+
+		n := MustParseModule(`for e in [1, 2, 3] {}`)
+		_, err := Eval(n, NewState(ctx))
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "cannot take 1 tokens from bucket ("+EXECUTION_TOTAL_LIMIT_NAME+")")
+		}
+	})
+}
+
+func TestLimitIterator(t *testing.T) {
+
+	newInfiniteIterator := func() Iterator {
+		i := 0
+		return NewFuncIterator(func(ctx *Context) (interface{}, bool) {
+			i++
+			return i, true
+		})
+	}
+
+	t.Run("Go iteration", func(t *testing.T) {
+		it := LimitIterator(newInfiniteIterator(), 5)
+		elements := List{}
+
+		for it.HasNext(nil) {
+			elements = append(elements, it.GetNext(nil))
+		}
+
+		assert.Equal(t, List{1, 2, 3, 4, 5}, elements)
+		assert.Panics(t, func() {
+			it.GetNext(nil)
+		})
+	})
+
+	t.Run("for statement", func(t *testing.T) {
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+		}, nil, nil)
+
+		n := MustParseModule(`$s = 0; for e in $$seq { $s = ($s + 1) }; return $s`)
+		state := NewState(ctx, map[string]interface{}{
+			"seq": LimitIterator(newInfiniteIterator(), 5),
+		})
+
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 5, res)
+	})
+}
+
+func TestFuncIterator(t *testing.T) {
+
+	newCounter := func(n int, calls *int) Iterator {
+		return NewFuncIterator(func(ctx *Context) (interface{}, bool) {
+			*calls++
+			if *calls > n {
+				return nil, false
+			}
+			return *calls, true
+		})
+	}
+
+	t.Run("Go iteration", func(t *testing.T) {
+		calls := 0
+		it := newCounter(3, &calls)
+		elements := List{}
+
+		for it.HasNext(nil) {
+			elements = append(elements, it.GetNext(nil))
+		}
+
+		assert.Equal(t, List{1, 2, 3}, elements)
+		assert.False(t, it.HasNext(nil))
+		assert.Equal(t, 4, calls)
+	})
+
+	t.Run("for statement", func(t *testing.T) {
+		calls := 0
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+		}, nil, []Limitation{
+			{Name: EXECUTION_TOTAL_LIMIT_NAME, Total: 4},
+		})
+
+		n := MustParseModule(`$s = 0; for i, e in $$seq { $s = ($s + $e) }; return $s`)
+		state := NewState(ctx, map[string]interface{}{
+			"seq": newCounter(3, &calls),
+		})
+
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.EqualValues(t, 6, res)
+		assert.Equal(t, 4, calls)
+
+		//one token is taken before the iteration & one for each element
+		assert.EqualValues(t, 0, ctx.limiters[EXECUTION_TOTAL_LIMIT_NAME].bucket.Availible())
+	})
+
+	t.Run("for statement : total limit reached", func(t *testing.T) {
+		calls := 0
+		ctx := NewContext([]Permission{
+			GlobalVarPermission{ReadPerm, "*"},
+		}, nil, []Limitation{
+			{Name: EXECUTION_TOTAL_LIMIT_NAME, Total: 3},
+		})
+
+		n := MustParseModule(`for e in $$seq {}`)
+		state := NewState(ctx, map[string]interface{}{
+			"seq": newCounter(3, &calls),
+		})
+
+		_, err := Eval(n, state)
+		assert.Error(t, err)
+	})
+}
+
+func TestToBool(t *testing.T) {
+
+	testCases := []struct {
+		name  string
+		input interface{}
+		ok    bool
+	}{
+		{"nil slice", ([]int)(nil), false},
+		{"empty, not-nil slice", []int{}, false},
+		{"not empty slice", []int{2}, true},
+		{"not empty pointer", &User{}, true},
+		{"empty pointer", (*User)(nil), false},
+		{"unitialized struct", User{}, true},
+		{"empty string", "", false},
+		{"not empty string", "1", true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.True(t, testCase.ok == toBool(ToReflectVal(testCase.input)))
+		})
+	}
+}
+
+func TestObjectSet(t *testing.T) {
+
+	t.Run("named key", func(t *testing.T) {
+		obj := Object{}
+		obj.Set("a", 1)
+		assert.Equal(t, Object{"a": 1}, obj)
+	})
+
+	t.Run("first index key", func(t *testing.T) {
+		obj := Object{}
+		obj.Set("0", 1)
+		assert.Equal(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, obj)
+	})
+
+	t.Run("existing index key", func(t *testing.T) {
+		obj := Object{"0": 1, "1": 2, IMPLICIT_KEY_LEN_KEY: 2}
+		obj.Set("0", 3)
+		assert.Equal(t, Object{"0": 3, "1": 2, IMPLICIT_KEY_LEN_KEY: 2}, obj)
+	})
+
+	t.Run("next index key", func(t *testing.T) {
+		obj := Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}
+		obj.Set("1", 2)
+		assert.Equal(t, Object{"0": 1, "1": 2, IMPLICIT_KEY_LEN_KEY: 2}, obj)
+	})
+
+	t.Run("index key with leading zeros", func(t *testing.T) {
+		obj := Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}
+		assert.Error(t, obj.Set("01", 2))
+		assert.Equal(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, obj)
+	})
+}
+
+func TestObjectDelete(t *testing.T) {
+
+	t.Run("named key", func(t *testing.T) {
+		obj := Object{"a": 1, "0": 1, IMPLICIT_KEY_LEN_KEY: 1}
+		obj.Delete("a")
+		assert.Equal(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, obj)
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		obj := Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}
+		obj.Delete("1")
+		assert.Equal(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, obj)
+	})
+
+	t.Run("last index key", func(t *testing.T) {
+		obj := Object{"0": 1, "1": 2, IMPLICIT_KEY_LEN_KEY: 2}
+		obj.Delete("1")
+		assert.Equal(t, Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}, obj)
+	})
+
+	t.Run("first index key", func(t *testing.T) {
+		obj := Object{"0": 1, "1": 2, "2": 3, IMPLICIT_KEY_LEN_KEY: 3}
+		obj.Delete("0")
+		assert.Equal(t, Object{"0": 2, "1": 3, IMPLICIT_KEY_LEN_KEY: 2}, obj)
+	})
+
+	t.Run("only index key", func(t *testing.T) {
+		obj := Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}
+		obj.Delete("0")
+		assert.Equal(t, Object{}, obj)
+	})
+}
+
+func TestObjectIterator(t *testing.T) {
+
+	obj := Object{"b": 1, "a": 2}
+	for i := 0; i < 12; i++ {
+		obj.Set(strconv.Itoa(i), i)
+	}
+
+	it := obj.Iterator().(*ObjectIterator)
+	keys := []string{}
+	values := List{}
+
+	for it.HasNext(nil) {
+		k, v := it.GetNextEntry(nil)
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+
+	assert.Equal(t, []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "a", "b"}, keys)
+	assert.Equal(t, List{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 2, 1}, values)
+	assert.NotContains(t, keys, IMPLICIT_KEY_LEN_KEY)
+}
+
+func TestObjectKeys(t *testing.T) {
+
+	t.Run("the order is stable", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			res, err := Eval(MustParseModule(`
+				$keys = [0, 0, 0, 0, 0]
+				$index = 0
+				for k, v in {c: 1, a: 2, :3, b: 4, :5} {
+					$keys[$index] = $k
+					$index = ($index + 1)
+				}
+				return $keys
+			`), NewState(NewDefaultTestContext()))
+
+			assert.NoError(t, err)
+			assert.Equal(t, List{"0", "1", "a", "b", "c"}, res)
+		}
+	})
+
+	t.Run("reserved keys are not included", func(t *testing.T) {
+		obj := Object{"a": 1, "0": 2, IMPLICIT_KEY_LEN_KEY: 1, KEY_ORDER_KEY: KeyList{"0", "a"}}
+		assert.Equal(t, []string{"0", "a"}, obj.Keys())
+	})
+
+	t.Run("index keys with leading zeros", func(t *testing.T) {
+		obj := Object{"01": 1, "1": 2, "10": 3, "2": 4}
+		assert.Equal(t, []string{"01", "1", "2", "10"}, obj.Keys())
+
+		it := obj.Iterator().(*ObjectIterator)
+		values := List{}
+		for it.HasNext(nil) {
+			_, v := it.GetNextEntry(nil)
+			values = append(values, v)
+		}
+		assert.Equal(t, List{1, 2, 4, 3}, values)
+	})
+
+	t.Run("in & keyof", func(t *testing.T) {
+		assert.Equal(t, true, parseEval(t, `return ("a" in {:"b", :"a"})`))
+		assert.Equal(t, false, parseEval(t, `return (2 in {:"b", :"a"})`))
+		assert.Equal(t, true, parseEval(t, `return (2 not-in {:"b", :"a"})`))
+		assert.Equal(t, true, parseEval(t, `return ("a" keyof {a: 1})`))
+		assert.Equal(t, false, parseEval(t, `return ("__len" keyof {:"b", :"a"})`))
+	})
+}
+
+func TestObjectKeyOrder(t *testing.T) {
+
+	evalOrdered := func(t *testing.T, s string) Object {
+		state := NewState(NewContext(nil, nil, nil))
+		state.PreserveKeyOrder = true
+		res, err := Eval(MustParseModule(s), state)
+		assert.NoError(t, err)
+		return res.(Object)
+	}
+
+	t.Run("keys are not ordered by default", func(t *testing.T) {
+		state := NewState(NewContext(nil, nil, nil))
+		res, err := Eval(MustParseModule(`return {b: 1, a: 2}`), state)
+		assert.NoError(t, err)
+
+		_, ok := res.(Object).KeyOrder()
+		assert.False(t, ok)
+
+		b, err := json.Marshal(res)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"a":2,"b":1}`, string(b))
+	})
+
+	t.Run("JSON encoding round-trip preserves key order", func(t *testing.T) {
+		obj := evalOrdered(t, `return {c: 1, a: {z: 2, y: 3}, b: 4}`)
+		assert.Equal(t, KeyList{"c", "a", "b"}, obj[KEY_ORDER_KEY])
+
+		b, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"c":1,"a":{"z":2,"y":3},"b":4}`, string(b))
+
+		objCopy, ok := deepCopyGopherVal(obj)
+		assert.True(t, ok)
+		b, err = json.Marshal(objCopy)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"c":1,"a":{"z":2,"y":3},"b":4}`, string(b))
+	})
+
+	t.Run("iteration", func(t *testing.T) {
+		obj := evalOrdered(t, `return {c: 1, a: 2, b: 3}`)
+		it := obj.Iterator().(*ObjectIterator)
+		keys := []string{}
+
+		for it.HasNext(nil) {
+			k, _ := it.GetNextEntry(nil)
+			keys = append(keys, k)
+		}
+		assert.Equal(t, []string{"c", "a", "b"}, keys)
+	})
+
+	t.Run("Set & Delete", func(t *testing.T) {
+		obj := evalOrdered(t, `return {c: 1, a: 2}`)
+		obj.Set("b", 3)
+		obj.Set("c", 4)
+		obj.Delete("a")
+
+		b, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"c":4,"b":3}`, string(b))
+	})
+
+	t.Run("member assignment", func(t *testing.T) {
+		obj := evalOrdered(t, `$o = {c: 1, a: 2}; $o.b = 3; return $o`)
+		assert.Equal(t, []string{"c", "a", "b"}, obj.Keys())
+
+		b, err := json.Marshal(obj)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"c":1,"a":2,"b":3}`, string(b))
+	})
+
+	t.Run("keys missing from the order", func(t *testing.T) {
+		obj := evalOrdered(t, `return {c: 1, a: 2}`)
+		obj["e"] = 3
+		obj["d"] = 4
+		assert.Equal(t, []string{"c", "a", "d", "e"}, obj.Keys())
+	})
+
+	t.Run("the order is not a member", func(t *testing.T) {
+		obj := evalOrdered(t, `return {a: 1}`)
+		v, _, err := Memb(obj, KEY_ORDER_KEY)
+		assert.NoError(t, err)
+		assert.Nil(t, v)
+	})
+
+	t.Run("reserved keys cannot be set or deleted", func(t *testing.T) {
+		obj := evalOrdered(t, `return {a: 1}`)
+		assert.Error(t, obj.Set(KEY_ORDER_KEY, 1))
+		assert.Error(t, obj.Set(IMPLICIT_KEY_LEN_KEY, 1))
+		assert.Error(t, obj.Delete(KEY_ORDER_KEY))
+		assert.Equal(t, KeyList{"a"}, obj[KEY_ORDER_KEY])
+
+		state := NewState(NewDefaultTestContext())
+		state.PreserveKeyOrder = true
+		_, err := Eval(MustParseModule(`$o = {a: 1}; $o.__order = 1; return $o`), state)
+		assert.Error(t, err)
+	})
+
+	t.Run("the order of shallow copies is not aliased", func(t *testing.T) {
+		order := make(KeyList, 1, 4)
+		order[0] = "a"
+
+		obj := Object{"a": 1, KEY_ORDER_KEY: order}
+		objCopy := Object{"a": 1, KEY_ORDER_KEY: order}
+
+		obj.Set("b", 2)
+		objCopy.Set("c", 3)
+		assert.Equal(t, []string{"a", "b"}, obj.Keys())
+		assert.Equal(t, []string{"a", "c"}, objCopy.Keys())
+	})
+
+	t.Run("the order is ignored by Diff", func(t *testing.T) {
+		obj := evalOrdered(t, `return {a: 1}`)
+		assert.Empty(t, Diff(obj, Object{"a": 1}))
+	})
+}
+
+func TestListAppend(t *testing.T) {
+	list := List{1}
+	list.Append(2, 3)
+	assert.Equal(t, List{1, 2, 3}, list)
+
+	list.Append()
+	assert.Equal(t, List{1, 2, 3}, list)
+}
+
+func TestIntRangeMinMaxClamp(t *testing.T) {
+
+	t.Run("inclusive end", func(t *testing.T) {
+		r := IntRange{inclusiveEnd: true, Start: 1, End: 3, Step: 1}
+		assert.Equal(t, 1, r.Min())
+		assert.Equal(t, 3, r.Max())
+		assert.Equal(t, 1, r.Clamp(0))
+		assert.Equal(t, 2, r.Clamp(2))
+		assert.Equal(t, 3, r.Clamp(3))
+		assert.Equal(t, 3, r.Clamp(4))
+	})
+
+	t.Run("exclusive end", func(t *testing.T) {
+		r := IntRange{Start: 1, End: 3, Step: 1}
+		assert.Equal(t, 1, r.Min())
+		assert.Equal(t, 2, r.Max())
+		assert.Equal(t, 1, r.Clamp(0))
+		assert.Equal(t, 2, r.Clamp(3))
+	})
+
+	t.Run("unknown start", func(t *testing.T) {
+		r := IntRange{unknownStart: true, inclusiveEnd: true, End: 3, Step: 1}
+		assert.Panics(t, func() { r.Min() })
+		assert.Equal(t, 3, r.Max())
+		assert.Equal(t, -10, r.Clamp(-10))
+		assert.Equal(t, 3, r.Clamp(4))
+	})
+}
+
+func TestListMinMaxInt(t *testing.T) {
+
+	t.Run("empty list", func(t *testing.T) {
+		_, err := List{}.MinInt()
+		assert.Error(t, err)
+
+		_, err = List{}.MaxInt()
+		assert.Error(t, err)
+	})
+
+	t.Run("non integer element", func(t *testing.T) {
+		_, err := List{1, "a"}.MinInt()
+		assert.Error(t, err)
+
+		_, err = List{1, 2.0}.MaxInt()
+		assert.Error(t, err)
+	})
+
+	t.Run("single element", func(t *testing.T) {
+		min, err := List{2}.MinInt()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, min)
+
+		max, err := List{2}.MaxInt()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, max)
+	})
+
+	t.Run("several elements", func(t *testing.T) {
+		min, err := List{3, -1, 5}.MinInt()
+		assert.NoError(t, err)
+		assert.Equal(t, -1, min)
+
+		max, err := List{3, -1, 5}.MaxInt()
+		assert.NoError(t, err)
+		assert.Equal(t, 5, max)
+	})
+}
+
+func TestRuneRangeIterator(t *testing.T) {
+	it := RuneRange{'a', 'c'}.Iterator()
+	runes := List{}
+
+	for it.HasNext(nil) {
+		runes = append(runes, it.GetNext(nil))
+	}
+
+	assert.Equal(t, List{'a', 'b', 'c'}, runes)
+	assert.Len(t, runes, 3)
+	assert.Panics(t, func() { it.GetNext(nil) })
+}
+
+func TestRuneRangeContains(t *testing.T) {
+	r := RuneRange{'b', 'y'}
+
+	t.Run("inside", func(t *testing.T) {
+		assert.True(t, r.Contains('m'))
+		assert.True(t, r.Test('m'))
+	})
+
+	t.Run("boundaries", func(t *testing.T) {
+		assert.True(t, r.Contains('b'))
+		assert.True(t, r.Contains('y'))
+	})
+
+	t.Run("outside", func(t *testing.T) {
+		assert.False(t, r.Contains('a'))
+		assert.False(t, r.Contains('z'))
+		assert.False(t, r.Test('z'))
+	})
+
+	t.Run("not a rune", func(t *testing.T) {
+		assert.False(t, r.Test("m"))
+	})
+}
+
+func TestQuantityRangeIterator(t *testing.T) {
+	it := QuantityRange{
+		inclusiveEnd: true,
+		Start:        time.Second,
+		End:          5 * time.Second,
+		Step:         2 * time.Second,
+	}.Iterator()
+	durations := List{}
+
+	for it.HasNext(nil) {
+		durations = append(durations, UnwrapReflectVal(it.GetNext(nil)))
+	}
+
+	assert.Equal(t, List{time.Second, 3 * time.Second, 5 * time.Second}, durations)
+	assert.Panics(t, func() { it.GetNext(nil) })
+
+	assert.Panics(t, func() {
+		QuantityRange{inclusiveEnd: true, Start: ByteRate(1), End: ByteRate(2)}.Iterator()
+	})
+	assert.Panics(t, func() {
+		QuantityRange{unknownStart: true, inclusiveEnd: true, End: time.Second}.Iterator()
+	})
+}
+
+func TestEvalQuantity(t *testing.T) {
+	testCases := []struct {
+		value    float64
+		unit     string
+		expected interface{}
+	}{
+		{2, "x", 2.0},
+		{2, "s", 2 * time.Second},
+		{2, "ms", 2 * time.Millisecond},
+		{50, "%", 0.5},
+		{2, "ln", LineCount(2)},
+		{2, "kB", ByteCount(2_000)},
+		{2, "MB", ByteCount(2_000_000)},
+		{2, "GB", ByteCount(2_000_000_000)},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.unit, func(t *testing.T) {
+			q, err := EvalQuantity(&QuantityLiteral{Value: testCase.value, Unit: testCase.unit})
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.expected, q)
+		})
+	}
+
+	t.Run("unsupported unit", func(t *testing.T) {
+		q, err := EvalQuantity(&QuantityLiteral{Value: 2, Unit: "min"})
+		assert.Error(t, err)
+		assert.Nil(t, q)
+	})
+
+	t.Run("unsupported unit in limits", func(t *testing.T) {
+		objLit := &ObjectLiteral{
+			Properties: []ObjectProperty{
+				{
+					Key: &IdentifierLiteral{Name: "limits"},
+					Value: &ObjectLiteral{
+						Properties: []ObjectProperty{
+							{
+								Key:   &StringLiteral{Value: EXECUTION_TOTAL_LIMIT_NAME},
+								Value: &QuantityLiteral{Value: 2, Unit: "min"},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		assert.PanicsWithValue(t, "invalid requirements, limits: execution/total-time: unsupported unit: min\n", func() {
+			objLit.PermissionsLimitations(nil, nil, nil, nil)
+		})
+	})
+}
+
+func TestRegisterUnit(t *testing.T) {
+	minute := func(v float64) interface{} {
+		return time.Duration(v * float64(time.Minute))
+	}
+
+	t.Run("custom unit", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		ctx.RegisterUnit("min", minute)
+
+		mod := MustParseModule(`return 5min`)
+		assert.Error(t, Check(mod))
+		assert.NoError(t, CheckWithContext(mod, ctx))
+
+		res, err := Eval(mod, NewState(ctx))
+		assert.NoError(t, err)
+		assert.Equal(t, 5*time.Minute, UnwrapReflectVal(res))
+	})
+
+	t.Run("custom unit in a routine", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		ctx.RegisterUnit("min", minute)
+
+		res, err := Eval(MustParseModule(`
+			$rt = sr nil { return 2min }
+			return $rt.WaitResult()!
+		`), NewState(ctx))
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Minute, UnwrapReflectVal(res.(ExternalValue).value))
+	})
+
+	t.Run("custom unit in an imported module", func(t *testing.T) {
+		client := &http.Client{
+			Transport: handlerTransport{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", GOPHERSCRIPT_MIMETYPE)
+				w.Write([]byte("return 3min"))
+			})},
+		}
+
+		ctx := NewDefaultTestContext()
+		ctx.RegisterUnit("min", minute)
+		ctx.SetModuleCache(NewModuleCache(1))
+		ctx.SetImportHttpClient(client)
+
+		res, err := Eval(MustParseModule(`
+			import importname https://modules.com/return_3min.gos "return-3min-hash" {} allow {}
+			return $$importname
+		`), NewState(ctx))
+		assert.NoError(t, err)
+		assert.Equal(t, 3*time.Minute, UnwrapReflectVal(res.(ExternalValue).value))
+	})
+
+	t.Run("unregistered unit", func(t *testing.T) {
+		_, err := Eval(MustParseModule(`return 5min`), NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid unit names", func(t *testing.T) {
+		ctx := NewDefaultTestContext()
+		assert.Panics(t, func() {
+			ctx.RegisterUnit("s", minute)
+		})
+		assert.Panics(t, func() {
+			ctx.RegisterUnit("m1", minute)
+		})
+		assert.Panics(t, func() {
+			ctx.RegisterUnit("", minute)
+		})
+	})
+}
+
+func TestQuantityFormatting(t *testing.T) {
+	testCases := []struct {
+		quantity fmt.Stringer
+		expected string
+	}{
+		{ByteCount(0), "0B"},
+		{ByteCount(999), "999B"},
+		{ByteCount(1_000), "1kB"},
+		{ByteCount(1_550), "1.5kB"},
+		{ByteCount(999_999), "999.9kB"},
+		{ByteCount(1_000_000), "1MB"},
+		{ByteCount(1_500_000), "1.5MB"},
+		{ByteCount(1_000_000_000), "1GB"},
+		{ByteCount(12_300_000_000), "12.3GB"},
+		{ByteCount(-2_000), "-2kB"},
+		{LineCount(0), "0ln"},
+		{LineCount(42), "42ln"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.expected, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, testCase.quantity.String())
+		})
+	}
+}
+
+func TestRates(t *testing.T) {
+
+	t.Run("formatting", func(t *testing.T) {
+		testCases := []struct {
+			rate     fmt.Stringer
+			expected string
+		}{
+			{ByteRate(500), "500B/s"},
+			{ByteRate(1_000), "1kB/s"},
+			{ByteRate(100_000), "100kB/s"},
+			{ByteRate(1_500_000), "1.5MB/s"},
+			{ByteRate(2_000_000_000), "2GB/s"},
+			{SimpleRate(10), "10x/s"},
+		}
+
+		for _, testCase := range testCases {
+			assert.Equal(t, testCase.expected, testCase.rate.String())
+		}
+	})
+
+	t.Run("comparing two byte rates", func(t *testing.T) {
+		state := NewState(NewDefaultTestContext())
+
+		res, err := Eval(MustParseModule(`return (100kB/s > 10kB/s)`), state)
+		assert.NoError(t, err)
+		assert.Equal(t, true, res)
+
+		res, err = Eval(MustParseModule(`return (1MB/s <= 999kB/s)`), state)
+		assert.NoError(t, err)
+		assert.Equal(t, false, res)
+	})
+
+	t.Run("comparing two simple rates", func(t *testing.T) {
+		res, err := Eval(MustParseModule(`return (5x/s < 10x/s)`), NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, true, res)
+	})
+
+	t.Run("comparing a byte rate with a simple rate", func(t *testing.T) {
+		_, err := Eval(MustParseModule(`return (5x/s < 10kB/s)`), NewState(NewDefaultTestContext()))
+		assert.ErrorAs(t, err, &TypeMismatchError{})
+	})
+}
 
-		ctx.Take("fs/total-read-file", 1)
+func TestPathDecomposition(t *testing.T) {
+	testCases := []struct {
+		path Path
+		base string
+		dir  Path
+		ext  string
+	}{
+		{"/", "/", "/", ""},
+		{"/a.txt", "a.txt", "/", ".txt"},
+		{"/a/b.tar.gz", "b.tar.gz", "/a/", ".gz"},
+		{"/a/b", "b", "/a/", ""},
+		{"/a/b/", "b/", "/a/", ""},
+		{"/a/b.d/", "b.d/", "/a/", ""},
+		{"./a.txt", "a.txt", "./", ".txt"},
+		{"./a/", "a/", "./", ""},
+		{"../a/Makefile", "Makefile", "../a/", ""},
+	}
 
-		assert.Panics(t, func() {
-			ctx.Take("fs/total-read-file", 1)
+	for _, testCase := range testCases {
+		t.Run(string(testCase.path), func(t *testing.T) {
+			assert.Equal(t, testCase.base, testCase.path.Base())
+			assert.Equal(t, testCase.dir, testCase.path.Dir())
+			assert.Equal(t, testCase.ext, testCase.path.Ext())
 		})
-	})
+	}
+}
 
-	t.Run("auto decrement", func(t *testing.T) {
-		ctx := NewContext(nil, nil, []Limitation{
-			{
-				Name:  "test",
-				Total: int64(time.Second),
-				DecrementFn: func(lastDecrementTime time.Time) int64 {
-					v := TOKEN_BUCKET_CAPACITY_SCALE * time.Since(lastDecrementTime)
-					return v.Nanoseconds()
-				},
-			},
-		})
+func TestURLWithQueryParam(t *testing.T) {
 
-		capacity := int64(time.Second * TOKEN_BUCKET_CAPACITY_SCALE)
+	t.Run("URL without query", func(t *testing.T) {
+		u, err := URL("https://example.com/users").WithQueryParam("page", "2")
+		assert.NoError(t, err)
+		assert.Equal(t, URL("https://example.com/users?page=2"), u)
+	})
 
-		assert.Equal(t, capacity, ctx.limiters["test"].bucket.avail)
-		time.Sleep(time.Second)
-		assert.InDelta(t, int64(0), ctx.limiters["test"].bucket.avail, float64(capacity/20))
+	t.Run("URL with an existing query", func(t *testing.T) {
+		u, err := URL("https://example.com/users?page=2").WithQueryParam("sort", "name asc")
+		assert.NoError(t, err)
+		assert.Equal(t, URL("https://example.com/users?page=2&sort=name+asc"), u)
+
+		u, err = u.WithQueryParam("page", "3")
+		assert.NoError(t, err)
+		assert.Equal(t, URL("https://example.com/users?page=2&page=3&sort=name+asc"), u)
 	})
 
+	t.Run("invalid URL", func(t *testing.T) {
+		_, err := URL("https://example.com/%zz").WithQueryParam("page", "2")
+		assert.Error(t, err)
+
+		_, err = URL("/users").WithQueryParam("page", "2")
+		assert.Error(t, err)
+	})
 }
 
-func TestToBool(t *testing.T) {
+func TestHTTPHostPatternTest(t *testing.T) {
 
-	testCases := []struct {
-		name  string
-		input interface{}
-		ok    bool
+	for _, testCase := range []struct {
+		pattern HTTPHostPattern
+		host    HTTPHost
+		ok      bool
 	}{
-		{"nil slice", ([]int)(nil), false},
-		{"empty, not-nil slice", []int{}, false},
-		{"not empty slice", []int{2}, true},
-		{"not empty pointer", &User{}, true},
-		{"empty pointer", (*User)(nil), false},
-		{"unitialized struct", User{}, true},
-		{"empty string", "", false},
-		{"not empty string", "1", true},
-	}
-
-	for _, testCase := range testCases {
-		t.Run(testCase.name, func(t *testing.T) {
-			assert.True(t, testCase.ok == toBool(ToReflectVal(testCase.input)))
+		//explicit ports
+		{"https://*.example.com:8443", "https://a.example.com:8443", true},
+		{"https://*.example.com:8443", "https://a.example.com:9443", false},
+		{"https://*.example.com:8443", "https://a.example.com", false},
+		{"http://example.com:8080", "http://example.com:8080", true},
+		{"http://example.com:8080", "http://example.com:80", false},
+
+		//default ports
+		{"https://*.example.com", "https://a.example.com:443", true},
+		{"https://*.example.com:443", "https://a.example.com", true},
+		{"http://example.com", "http://example.com:80", true},
+		{"https://*.example.com", "https://a.example.com:8443", false},
+
+		//wildcard ports
+		{"https://*.example.com:*", "https://a.example.com:8443", true},
+		{"https://*.example.com:*", "https://a.example.com:443", true},
+		{"https://*.example.com:*", "https://a.example.com", true},
+		{"https://*.example.com:*", "https://a.example.org:8443", false},
+		{"https://*:*", "https://localhost:3000", true},
+		{"https://*:*", "http://localhost:3000", false},
+	} {
+		t.Run(string(testCase.pattern)+" "+string(testCase.host), func(t *testing.T) {
+			assert.Equal(t, testCase.ok, testCase.pattern.Test(testCase.host))
 		})
 	}
 }
@@ -8041,6 +12536,83 @@ func TestPathPatternTest(t *testing.T) {
 	assert.True(t, PathPattern("/*").Test(Path("/e")))
 	assert.False(t, PathPattern("/*").Test(Path("/e/")))
 	assert.False(t, PathPattern("/*").Test(Path("/e/e")))
+
+	//escaped delimiters
+	assert.True(t, PathPattern(`/a\,*`).Test(Path("/a,b")))
+	assert.False(t, PathPattern(`/a\,*`).Test(Path("/ab")))
+}
+
+func TestPathPatternUnion(t *testing.T) {
+
+	t.Run("Test", func(t *testing.T) {
+		union := PathPatternUnion{"/a/*", "/b/..."}
+		assert.True(t, union.Test(Path("/a/x")))
+		assert.True(t, union.Test(Path("/b/x/y")))
+		assert.False(t, union.Test(Path("/c/x")))
+		assert.False(t, union.Test("/a/x"))
+	})
+
+	t.Run("pattern definition", func(t *testing.T) {
+		n := MustParseModule(`
+			%p = | /a/* | /b/*;
+			return [(/a/x match %p), (/b/y match %p), (/c/x match %p)]
+		`)
+		state := NewState(NewDefaultTestContext())
+		res, err := Eval(n, state)
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, false}, res)
+		assert.Equal(t, PathPatternUnion{"/a/*", "/b/*"}, state.ctx.resolveNamedPattern("p"))
+	})
+
+	t.Run("pattern definition with relative path patterns", func(t *testing.T) {
+		n := MustParseModule(`
+			%p = | ./a/* | ../b/*;
+			return [(./a/x match %p), (../b/y match %p), (./b/y match %p)]
+		`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		assert.Equal(t, List{true, true, false}, res)
+	})
+
+	t.Run("union of a path pattern and a string", func(t *testing.T) {
+		n := MustParseModule(`%p = | /a/* | "a"`)
+		_, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.Error(t, err)
+	})
+}
+
+func TestPathPatternMatches(t *testing.T) {
+
+	for _, testCase := range []struct {
+		pattern PathPattern
+		path    Path
+		groups  map[string]interface{}
+	}{
+		{"/users/*", "/users/bob", map[string]interface{}{"0": "bob"}},
+		{"/users/*", "/users/bob/posts", nil},
+		{"/users/*/posts/*.json", "/users/bob/posts/1.json", map[string]interface{}{"0": "bob", "1": "1"}},
+		{"/users/*/posts/*.json", "/users/bob/1.json", nil},
+		{"/files/file-?-[a-c]", "/files/file-1-b", map[string]interface{}{"0": "1", "1": "b"}},
+		{"/foo/...", "/foo/a/b", map[string]interface{}{"rest": "a/b"}},
+		{"/foo/...", "/bar/a", nil},
+	} {
+		t.Run(string(testCase.pattern)+" "+string(testCase.path), func(t *testing.T) {
+			ok, groups, err := testCase.pattern.Matches(testCase.path)
+			assert.NoError(t, err)
+			assert.Equal(t, testCase.groups != nil, ok)
+			assert.Equal(t, testCase.groups, groups)
+		})
+	}
+
+	t.Run("groups that cannot be captured", func(t *testing.T) {
+		patt := PathPattern(`/a/[\]]`)
+		assert.True(t, patt.Test(Path("/a/]")))
+
+		ok, groups, err := patt.Matches("/a/]")
+		assert.Error(t, err)
+		assert.False(t, ok)
+		assert.Nil(t, groups)
+	})
 }
 
 func TestNamedSegmentPathPatternTest(t *testing.T) {
@@ -8193,6 +12765,28 @@ func TestCompileStringPatternNode(t *testing.T) {
 		assert.Equal(t, "(s){2}", patt.Regex())
 	})
 
+	t.Run("single element : string literal (ocurrence modifier is '={2,4}')", func(t *testing.T) {
+		state := NewState(NewContext(nil, nil, nil))
+
+		patt, err := CompileStringPatternNode(&PatternPiece{
+			Kind: StringPattern,
+			Elements: []*PatternPieceElement{
+				{
+					Ocurrence:         RangeOcurrence,
+					MinOcurrenceCount: 2,
+					MaxOcurrenceCount: 4,
+					Expr:              &StringLiteral{Value: "s"},
+				},
+			},
+		}, state)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "(s){2,4}", patt.Regex())
+		assert.False(t, patt.Test("s"))
+		assert.True(t, patt.Test("ss"))
+		assert.True(t, patt.Test("ssss"))
+	})
+
 	t.Run("two elements : one string literal + a pattern identifier (exact string matcher)", func(t *testing.T) {
 		ctx := NewContext(nil, nil, nil)
 		ctx.addNamedPattern("b", ExactSimpleValueMatcher{"c"})
@@ -8272,6 +12866,64 @@ func TestCompileStringPatternNode(t *testing.T) {
 	})
 }
 
+func TestStringPatternCache(t *testing.T) {
+
+	t.Run("a literal pattern should be compiled once", func(t *testing.T) {
+		mod := MustParseModule(`%p = string "a"+ "b";`)
+		node := mod.Statements[0].(*PatternDefinition).Right
+		state := NewState(NewDefaultTestContext())
+
+		patt1, err := Eval(node, state)
+		assert.NoError(t, err)
+		patt2, err := Eval(node, state)
+		assert.NoError(t, err)
+
+		assert.Same(t, patt1, patt2)
+		assert.True(t, patt1.(Matcher).Test("aab"))
+		assert.False(t, patt1.(Matcher).Test("ba"))
+	})
+
+	t.Run("a pattern containing a named pattern", func(t *testing.T) {
+		mod := MustParseModule(`%p = string %s "b";`)
+		node := mod.Statements[0].(*PatternDefinition).Right
+		state := NewState(NewDefaultTestContext())
+
+		//the pattern cannot be compiled before %s is defined
+		_, err := Eval(node, state)
+		assert.Error(t, err)
+
+		state.ctx.addNamedPattern("s", ExactSimpleValueMatcher{"a"})
+		patt1, err := Eval(node, state)
+		assert.NoError(t, err)
+		patt2, err := Eval(node, state)
+		assert.NoError(t, err)
+
+		assert.Same(t, patt1, patt2)
+		assert.True(t, patt1.(Matcher).Test("ab"))
+	})
+}
+
+func BenchmarkStringPatternCompilation(b *testing.B) {
+	mod := MustParseModule(`%p = string "a"+ "b"=2 "c"?;`)
+	node := mod.Statements[0].(*PatternDefinition).Right
+
+	b.Run("uncached", func(b *testing.B) {
+		state := NewState(NewDefaultTestContext())
+		for i := 0; i < b.N; i++ {
+			patt, _ := CompileStringPatternNode(node, state)
+			patt.Test("aabb")
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		state := NewState(NewDefaultTestContext())
+		for i := 0; i < b.N; i++ {
+			patt, _ := Eval(node, state)
+			patt.(Matcher).Test("aabb")
+		}
+	})
+}
+
 func TestRepeatedPatternElementRandom(t *testing.T) {
 
 	t.Run("2 ocurrences of constant string", func(t *testing.T) {
@@ -8287,6 +12939,23 @@ func TestRepeatedPatternElementRandom(t *testing.T) {
 		}
 	})
 
+	t.Run("2 to 4 ocurrences of constant string", func(t *testing.T) {
+		patt := RepeatedPatternElement{
+			regexp:            nil,
+			ocurrenceModifier: RangeOcurrence,
+			minCount:          2,
+			maxCount:          4,
+			element:           ExactSimpleValueMatcher{"a"},
+		}
+
+		for i := 0; i < 20; i++ {
+			s := patt.Random().(string)
+			assert.Equal(t, strings.Repeat("a", len(s)), s)
+			assert.GreaterOrEqual(t, len(s), 2)
+			assert.LessOrEqual(t, len(s), 4)
+		}
+	})
+
 	t.Run("optional ocurrence of constant string", func(t *testing.T) {
 		patt := RepeatedPatternElement{
 			regexp:            nil,
@@ -8363,6 +13032,221 @@ func TestUnionStringPatternRandom(t *testing.T) {
 
 }
 
+func TestEmptyObjectPattern(t *testing.T) {
+
+	n := MustParseModule(`%{}`)
+	res, err := Eval(n, NewState(NewDefaultTestContext()))
+	assert.NoError(t, err)
+	patt := res.(*ObjectPattern)
+
+	assert.True(t, patt.Test(Object{}))
+	assert.True(t, patt.Test(Object{"a": 1}))
+	assert.True(t, patt.Test(Object{"0": 1, IMPLICIT_KEY_LEN_KEY: 1}))
+
+	assert.False(t, patt.Test(List{}))
+	assert.False(t, patt.Test(1))
+	assert.False(t, patt.Test(nil))
+
+	assert.Equal(t, true, parseEval(t, `return ({a: 1} match %{})`))
+	assert.Equal(t, false, parseEval(t, `return ([] match %{})`))
+}
+
+func TestClosedObjectPattern(t *testing.T) {
+
+	t.Run("open", func(t *testing.T) {
+		res := parseEval(t, `return %{a: 1}`)
+		patt := res.(*ObjectPattern)
+
+		assert.False(t, patt.Closed)
+		assert.True(t, patt.Test(Object{"a": 1}))
+		assert.True(t, patt.Test(Object{"a": 1, "b": 2}))
+		assert.False(t, patt.Test(Object{"b": 2}))
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		res := parseEval(t, `return %{a: 1}!`)
+		patt := res.(*ObjectPattern)
+
+		assert.True(t, patt.Closed)
+		assert.True(t, patt.Test(Object{"a": 1}))
+		assert.False(t, patt.Test(Object{"a": 1, "b": 2}))
+		assert.False(t, patt.Test(Object{"b": 2}))
+
+		//reserved keys are not additional entries
+		assert.True(t, patt.Test(Object{"a": 1, KEY_ORDER_KEY: KeyList{"a"}}))
+	})
+
+	t.Run("empty closed pattern", func(t *testing.T) {
+		assert.Equal(t, true, parseEval(t, `return ({} match %{}!)`))
+		assert.Equal(t, false, parseEval(t, `return ({a: 1} match %{}!)`))
+	})
+}
+
+func TestNestedObjectPattern(t *testing.T) {
+
+	testCases := []struct {
+		name    string
+		pattern string
+	}{
+		{"nested pattern literals", `%{a: %{b: %{c: 1}, d: 'a'..'z'}}`},
+		{"nested object literals", `%{a: {b: {c: 1}, d: 'a'..'z'}}`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			patt := parseEval(t, "return "+testCase.pattern).(*ObjectPattern)
+
+			assert.True(t, patt.Test(Object{"a": Object{"b": Object{"c": 1}, "d": 'x'}}))
+			assert.True(t, patt.Test(Object{"a": Object{"b": Object{"c": 1, "e": 3}, "d": 'x'}, "f": 4}))
+
+			assert.False(t, patt.Test(Object{"a": Object{"b": Object{"c": 2}, "d": 'x'}}))
+			assert.False(t, patt.Test(Object{"a": Object{"b": Object{"c": 1}, "d": "x"}}))
+			assert.False(t, patt.Test(Object{"a": Object{"b": 1, "d": 'x'}}))
+			assert.False(t, patt.Test(Object{"a": Object{"d": 'x'}}))
+		})
+	}
+
+	t.Run("match expression", func(t *testing.T) {
+		assert.Equal(t, true, parseEval(t, `return ({a: {b: {c: 1}}} match %{a: {b: {c: 1}}})`))
+		assert.Equal(t, false, parseEval(t, `return ({a: {b: {c: 2}}} match %{a: {b: {c: 1}}})`))
+	})
+
+	t.Run("nested list literal", func(t *testing.T) {
+		patt := parseEval(t, `return %{a: [1, {b: 2}]}`).(*ObjectPattern)
+
+		assert.True(t, patt.Test(Object{"a": List{1, Object{"b": 2}}}))
+		assert.False(t, patt.Test(Object{"a": List{1, Object{"b": 3}}}))
+	})
+
+	t.Run("nested object literal with implicit keys", func(t *testing.T) {
+		for _, code := range []string{`return %{a: {:1}}`, `return %[{b: 1, :2}]`} {
+			_, err := Eval(MustParseModule(code), NewState(NewDefaultTestContext()))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "implicit keys")
+			}
+		}
+	})
+}
+
+func TestEmptyListPattern(t *testing.T) {
+
+	n := MustParseModule(`%[]`)
+	res, err := Eval(n, NewState(NewDefaultTestContext()))
+	assert.NoError(t, err)
+	patt := res.(*ListPattern)
+
+	assert.True(t, patt.Test(List{}))
+
+	assert.False(t, patt.Test(List{1}))
+	assert.False(t, patt.Test(Object{}))
+	assert.False(t, patt.Test(nil))
+
+	assert.Equal(t, true, parseEval(t, `return ([] match %[])`))
+	assert.Equal(t, false, parseEval(t, `return ([1] match %[])`))
+}
+
+func TestListPatternWithRest(t *testing.T) {
+
+	t.Run("rest without matcher", func(t *testing.T) {
+		n := MustParseModule(`%[1, ...]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		patt := res.(*ListPattern)
+
+		assert.True(t, patt.Test(List{1}))
+		assert.True(t, patt.Test(List{1, 2}))
+		assert.True(t, patt.Test(List{1, "a", 3}))
+
+		assert.False(t, patt.Test(List{}))
+		assert.False(t, patt.Test(List{2, 1}))
+	})
+
+	t.Run("rest with a matcher", func(t *testing.T) {
+		n := MustParseModule(`%[1, ...2]`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+		patt := res.(*ListPattern)
+
+		assert.True(t, patt.Test(List{1}))
+		assert.True(t, patt.Test(List{1, 2}))
+		assert.True(t, patt.Test(List{1, 2, 2}))
+
+		assert.False(t, patt.Test(List{}))
+		assert.False(t, patt.Test(List{1, 2, 3}))
+	})
+
+	t.Run("only a rest element", func(t *testing.T) {
+		assert.Equal(t, true, parseEval(t, `return ([] match %[...])`))
+		assert.Equal(t, true, parseEval(t, `return ([1, 2] match %[...])`))
+		assert.Equal(t, false, parseEval(t, `return ({} match %[...])`))
+	})
+
+	t.Run("match expression", func(t *testing.T) {
+		assert.Equal(t, true, parseEval(t, `%s = | "a" | "b"; return ([1, "a", "b"] match %[1, ...%s])`))
+		assert.Equal(t, false, parseEval(t, `%s = | "a" | "b"; return ([1, "a", "c"] match %[1, ...%s])`))
+	})
+}
+
+func TestObjectPatternRandom(t *testing.T) {
+
+	t.Run("generative entry matchers", func(t *testing.T) {
+		n := MustParseModule(`%u = | "b" | "c"; return %{a: "a", b: %u, c: %["d", 2]}`)
+		res, err := Eval(n, NewState(NewDefaultTestContext()))
+		assert.NoError(t, err)
+
+		patt := res.(*ObjectPattern)
+
+		for i := 0; i < 5; i++ {
+			v := patt.Random()
+			assert.True(t, patt.Test(v), "%#v", v)
+		}
+	})
+
+	t.Run("non generative entry matcher", func(t *testing.T) {
+		patt := ObjectPattern{
+			EntryMatchers: map[string]Matcher{
+				"a": RegexMatcher{regexp.MustCompile("a+")},
+			},
+		}
+
+		assert.Panics(t, func() {
+			patt.Random()
+		})
+	})
+}
+
+func TestListPatternRandom(t *testing.T) {
+
+	t.Run("generative element matchers", func(t *testing.T) {
+		patt := ListPattern{
+			ElementMatchers: []Matcher{
+				ExactSimpleValueMatcher{"a"},
+				&ObjectPattern{
+					EntryMatchers: map[string]Matcher{
+						"b": ExactSimpleValueMatcher{"b"},
+					},
+				},
+			},
+		}
+
+		v := patt.Random()
+		assert.Equal(t, List{"a", Object{"b": "b"}}, v)
+		assert.True(t, patt.Test(v))
+	})
+
+	t.Run("non generative element matcher", func(t *testing.T) {
+		patt := ListPattern{
+			ElementMatchers: []Matcher{
+				RegexMatcher{regexp.MustCompile("a+")},
+			},
+		}
+
+		assert.Panics(t, func() {
+			patt.Random()
+		})
+	})
+}
+
 func TestShiftNodeSpans(t *testing.T) {
 
 	node := &Module{
@@ -8565,3 +13449,32 @@ func TestCookieJar(t *testing.T) {
 
 	})
 }
+
+func TestNodeString(t *testing.T) {
+
+	testCases := []struct {
+		code   string
+		result string
+	}{
+		{"1", "IntLiteral(1)"},
+		{`"a"`, `StringLiteral("a")`},
+		{"($a + 1)", "BinaryExpression(+, Variable(a), IntLiteral(1))"},
+		{`f("a" $$b)`, `Call(IdentifierLiteral(f), StringLiteral("a"), GlobalVariable(b))`},
+		{"$a.b", "MemberExpression(Variable(a), b)"},
+		{"[1, nil]", "ListLiteral(IntLiteral(1), NilLiteral)"},
+		{"{a: 1}", "ObjectLiteral(a: IntLiteral(1))"},
+		{"$a = 1", "Assignment(Variable(a), IntLiteral(1))"},
+		{"if true { } else { 1 }", "IfStatement(BooleanLiteral(true), Block(0 statements), Block(1 statements))"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.code, func(t *testing.T) {
+			mod := MustParseModule(testCase.code)
+			assert.Equal(t, testCase.result, mod.Statements[0].(fmt.Stringer).String())
+		})
+	}
+
+	t.Run("module", func(t *testing.T) {
+		assert.Equal(t, "Module(2 statements)", MustParseModule("1\n2").String())
+	})
+}